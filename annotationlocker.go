@@ -0,0 +1,202 @@
+package lockheed
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	kretry "k8s.io/client-go/util/retry"
+)
+
+const objectLockAnnotation = "lockheed/lock"
+
+// ObjectAnnotationLocker stores lock state in an annotation of existing Kubernetes objects
+// of one resource type, the lock name being the name of the object. Objects are never
+// created, so locking a missing object fails and deleting an object drops its lock.
+type ObjectAnnotationLocker struct {
+	Client    dynamic.Interface
+	Resource  schema.GroupVersionResource
+	Namespace string
+	// Annotation holds the key of the annotation storing the lock state
+	Annotation string
+	Clock      Clock
+}
+
+// NewObjectAnnotationLocker returns a locker for objects of resource within namespace,
+// which is left empty for cluster scoped resources
+func NewObjectAnnotationLocker(client dynamic.Interface, resource schema.GroupVersionResource, namespace string) *ObjectAnnotationLocker {
+	locker := &ObjectAnnotationLocker{
+		Client:     client,
+		Resource:   resource,
+		Namespace:  namespace,
+		Annotation: objectLockAnnotation,
+	}
+	return locker
+}
+
+func (locker *ObjectAnnotationLocker) resource() dynamic.ResourceInterface {
+	if locker.Namespace == "" {
+		return locker.Client.Resource(locker.Resource)
+	}
+	return locker.Client.Resource(locker.Resource).Namespace(locker.Namespace)
+}
+
+func (locker *ObjectAnnotationLocker) GetObject(l *Lock) (*unstructured.Unstructured, error) {
+	return locker.resource().Get(l.OperationContext(), l.Name, metav1.GetOptions{})
+}
+
+// decodeObject reads the lock state out of the annotation of obj, if there is one
+func (locker *ObjectAnnotationLocker) decodeObject(obj *unstructured.Unstructured) (*Lock, bool, error) {
+	lockState := &Lock{Name: obj.GetName()}
+	data, exists := obj.GetAnnotations()[locker.Annotation]
+	if !exists {
+		return lockState, false, nil
+	}
+	if err := decodeLockState([]byte(data), lockState); err != nil {
+		return nil, true, fmt.Errorf("Invalid lock state in annotation %s of %s: %w", locker.Annotation, obj.GetName(), err)
+	}
+	return lockState, true, nil
+}
+
+// modify runs a single read-modify-write cycle of the lock state stored in the annotation,
+// patching it with the resourceVersion of the object read as precondition and retrying on
+// conflicts. A missing object is reported as ErrLockNotFound.
+func (locker *ObjectAnnotationLocker) modify(l *Lock, fn func(lockState *Lock) error) error {
+	var fnErr error
+	err := kretry.RetryOnConflict(kretry.DefaultBackoff, func() error {
+		fnErr = nil
+		obj, err := locker.GetObject(l)
+		if apierrors.IsNotFound(err) {
+			return fmt.Errorf("Lock %s does not exist: %w", l.Name, ErrLockNotFound)
+		}
+		if err != nil {
+			return err
+		}
+		lockState, _, err := locker.decodeObject(obj)
+		if err != nil {
+			return err
+		}
+
+		updated, changed, err := applyChange(lockState, fn)
+		if updated == nil {
+			return err
+		}
+		fnErr = err
+		if !changed {
+			return nil
+		}
+
+		patch, err := json.Marshal(map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"resourceVersion": obj.GetResourceVersion(),
+				"annotations": map[string]string{
+					locker.Annotation: string(updated),
+				},
+			},
+		})
+		if err != nil {
+			return err
+		}
+		_, err = locker.resource().Patch(l.OperationContext(), obj.GetName(), types.MergePatchType, patch, metav1.PatchOptions{})
+		if apierrors.IsNotFound(err) {
+			return fmt.Errorf("Lock %s does not exist: %w", l.Name, ErrLockNotFound)
+		}
+		return err
+	})
+	if err != nil {
+		return kubeConflict(l, err)
+	}
+	return fnErr
+}
+
+// GetAllLocks returns the lock state of all objects carrying the lock annotation
+func (locker *ObjectAnnotationLocker) GetAllLocks() ([]*Lock, error) {
+	var result []*Lock
+	list, err := locker.resource().List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		return result, err
+	}
+	for i := range list.Items {
+		lockState, exists, err := locker.decodeObject(&list.Items[i])
+		if err != nil {
+			return result, err
+		}
+		if exists {
+			result = append(result, lockState)
+		}
+	}
+	return result, nil
+}
+
+// GetLock returns the lock state of the named object, an object without the lock
+// annotation is reported as not existing lock
+func (locker *ObjectAnnotationLocker) GetLock(name string) (*Lock, error) {
+	obj, err := locker.GetObject(&Lock{Name: name, Context: context.Background()})
+	if apierrors.IsNotFound(err) {
+		return nil, fmt.Errorf("Lock %s does not exist: %w", name, ErrLockNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	lockState, exists, err := locker.decodeObject(obj)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("Lock %s does not exist: %w", name, ErrLockNotFound)
+	}
+	return lockState, nil
+}
+
+func (locker *ObjectAnnotationLocker) Acquire(l *Lock) error {
+	return locker.modify(l, func(lockState *Lock) error {
+		return lockState.grant(l)
+	})
+}
+
+func (locker *ObjectAnnotationLocker) Renew(l *Lock) error {
+	return locker.modify(l, func(lockState *Lock) error {
+		return lockState.renew(l)
+	})
+}
+
+func (locker *ObjectAnnotationLocker) Release(l *Lock) error {
+	return locker.modify(l, func(lockState *Lock) error {
+		lockState.release(l)
+		return nil
+	})
+}
+
+// WaitForChange watches the locked object and returns as soon as it changes or
+// a lease on the lock expires
+func (locker *ObjectAnnotationLocker) WaitForChange(ctx context.Context, l *Lock) error {
+	obj, err := locker.GetObject(l)
+	if err != nil {
+		return err
+	}
+	lockState, _, err := locker.decodeObject(obj)
+	if err != nil {
+		return err
+	}
+	opts := metav1.ListOptions{
+		FieldSelector:   fields.OneTermEqualSelector("metadata.name", obj.GetName()).String(),
+		ResourceVersion: obj.GetResourceVersion(),
+	}
+	w, err := locker.resource().Watch(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer w.Stop()
+	return waitForWatchOrExpiry(ctx, w, lockState, l)
+}
+
+func (locker *ObjectAnnotationLocker) clock() Clock {
+	return clockOrReal(locker.Clock)
+}
@@ -0,0 +1,70 @@
+package lockheed
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+var deploymentGVR = schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+
+func newTestDeployment(name string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion("apps/v1")
+	obj.SetKind("Deployment")
+	obj.SetNamespace("default")
+	obj.SetName(name)
+	return obj
+}
+
+func TestObjectAnnotationLocker(t *testing.T) {
+	client := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), newTestDeployment("app"), newTestDeployment("other"))
+	locker := NewObjectAnnotationLocker(client, deploymentGVR, "default")
+
+	lockA := NewLock("app", locker).WithDuration(10 * time.Second).WithTags([]string{"deploy"})
+	if err := lockA.Acquire(); err != nil {
+		t.Error(err)
+	}
+	lockB := NewLock("app", locker).WithDuration(10 * time.Second)
+	if err := lockB.Acquire(); err == nil {
+		t.Error("Failure expected")
+	}
+	missing := NewLock("missing", locker).WithDuration(10 * time.Second)
+	if err := missing.Acquire(); !errors.Is(err, ErrLockNotFound) {
+		t.Errorf("Expected locking a missing object to fail with ErrLockNotFound, got %v", err)
+	}
+
+	obj, err := locker.GetObject(lockA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := obj.GetAnnotations()[objectLockAnnotation]; !exists {
+		t.Error("Expected lock annotation on the object")
+	}
+	locks, err := locker.GetAllLocks()
+	if err != nil {
+		t.Error(err)
+	}
+	if len(locks) != 1 || locks[0].Name != "app" || len(locks[0].Tags) != 1 {
+		t.Error("Lock not listed as expected")
+	}
+
+	if err := lockA.Release(); err != nil {
+		t.Error(err)
+	}
+	if err := lockB.Acquire(); err != nil {
+		t.Error(err)
+	}
+	if err := client.Resource(deploymentGVR).Namespace("default").Delete(lockB.Context, "app", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := lockB.Release(); !errors.Is(err, ErrLockNotFound) {
+		t.Errorf("Expected release of a deleted object to fail with ErrLockNotFound, got %v", err)
+	}
+}
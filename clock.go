@@ -0,0 +1,60 @@
+package lockheed
+
+import "time"
+
+// Clock provides the time used for lease timing, so that expiry and renewals can be
+// driven by tests, see lockheedtest.FakeClock. Only types of the standard library are
+// used, so that implementations do not need to import this package.
+type Clock interface {
+	Now() time.Time
+	// AfterFunc calls f in its own goroutine once d elapsed, unless the returned
+	// stop function is called first. Stop reports whether it prevented the call.
+	AfterFunc(d time.Duration, f func()) (stop func() bool)
+}
+
+// RealClock is the Clock backed by the time package, used unless another one is set
+var RealClock Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) func() bool {
+	return time.AfterFunc(d, f).Stop
+}
+
+// clockOrReal returns c, or RealClock if no clock was set
+func clockOrReal(c Clock) Clock {
+	if c == nil {
+		return RealClock
+	}
+	return c
+}
+
+// clockTimer returns a channel receiving the time of c once d elapsed and the function
+// stopping the timer
+func clockTimer(c Clock, d time.Duration) (<-chan time.Time, func() bool) {
+	fired := make(chan time.Time, 1)
+	stop := c.AfterFunc(d, func() {
+		fired <- c.Now()
+	})
+	return fired, stop
+}
+
+// clockedLocker is implemented by the lockers of this package through their Clock field.
+// It provides the time for reading lock state outside of operations on a lock, such as
+// listing or describing locks, and is RealClock unless set. Operations on a lock use the
+// clock of the lock instead.
+type clockedLocker interface {
+	clock() Clock
+}
+
+// lockerClock returns the clock of locker, RealClock if it has none
+func lockerClock(locker LockerInterface) Clock {
+	if clocked, ok := locker.(clockedLocker); ok {
+		return clocked.clock()
+	}
+	return RealClock
+}
@@ -0,0 +1,139 @@
+package lockheed
+
+import (
+	"testing"
+	"time"
+
+	"github.com/goblain/lockheed/lockheedtest"
+)
+
+var _ Clock = &lockheedtest.FakeClock{}
+
+// waitForTimers waits until at least count functions are scheduled on clock
+func waitForTimers(t *testing.T, clock *lockheedtest.FakeClock, count int) {
+	deadline := time.Now().Add(time.Second)
+	for clock.Waiters() < count {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d scheduled timers, got %d", count, clock.Waiters())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFakeClockExpiry(t *testing.T) {
+	clock := lockheedtest.NewFakeClock(time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC))
+	locker := NewMemoryLocker()
+	lockA := NewLock("timed", locker).WithDuration(time.Minute).WithClock(clock)
+	lockB := NewLock("timed", locker).WithDuration(time.Minute).WithClock(clock)
+	if err := lockA.Acquire(); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(59 * time.Second)
+	if err := lockB.Acquire(); err == nil {
+		t.Error("Failure expected")
+	}
+
+	clock.Advance(time.Second)
+	select {
+	case <-lockA.Lost():
+	case <-time.After(time.Second):
+		t.Error("Expected lease to be lost on expiry")
+	}
+	if err := lockB.Acquire(); err != nil {
+		t.Error(err)
+	}
+	status, err := lockB.Describe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Holders) != 1 || status.Holders[0].TTL != time.Minute {
+		t.Errorf("Expected a full minute left, got %+v", status.Holders)
+	}
+}
+
+func TestFakeClockMaintain(t *testing.T) {
+	clock := lockheedtest.NewFakeClock(time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC))
+	lock := NewLock("maintained", NewMemoryLocker()).
+		WithDuration(time.Minute).
+		WithRenewInterval(20 * time.Second).
+		WithClock(clock).
+		WithEventHandler(nil)
+	sub, err := lock.Subscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	if err := lock.Acquire(); err != nil {
+		t.Fatal(err)
+	}
+
+	// hold expiry and renewal tick
+	for i := 0; i < 5; i++ {
+		waitForTimers(t, clock, 2)
+		clock.Advance(20 * time.Second)
+		for renewed := false; !renewed; {
+			select {
+			case event := <-sub.C:
+				renewed = event.Code == EventRenewSuccessful
+			case <-time.After(time.Second):
+				t.Fatal("Expected renewal on tick")
+			}
+		}
+	}
+	if lock.State() != LockStateHeld {
+		t.Errorf("Expected lock to be kept held, got %s", lock.State())
+	}
+	lock.Release()
+}
+
+func TestFakeClockRetry(t *testing.T) {
+	clock := lockheedtest.NewFakeClock(time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC))
+	locker := NewMemoryLocker()
+	lockA := NewLock("retried", locker).WithDuration(time.Minute).WithClock(clock)
+	lockB := NewLock("retried", locker).WithDuration(time.Minute).WithClock(clock)
+	if err := lockA.Acquire(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- lockB.Acquire(AcquireOptionWithBackoff(3, 30*time.Second, 0, 1))
+	}()
+
+	// hold expiry of lockA and delay before the next attempt of lockB
+	for i := 0; i < 2; i++ {
+		waitForTimers(t, clock, 2)
+		clock.Advance(30 * time.Second)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected retries to follow the clock of the lock")
+	}
+	lockB.Release()
+}
+
+func TestFakeClockLocker(t *testing.T) {
+	clock := lockheedtest.NewFakeClock(time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC))
+	locker := NewMemoryLocker()
+	locker.Clock = clock
+	if err := NewLock("listed", locker).WithDuration(time.Minute).WithClock(clock).Acquire(); err != nil {
+		t.Fatal(err)
+	}
+	status, err := Describe(locker, "listed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Holders) != 1 || status.Holders[0].TTL != time.Minute {
+		t.Errorf("Expected a full minute left, got %+v", status.Holders)
+	}
+	locks, err := GetLocks(locker, &Condition{Operation: OperationEquals, Field: FieldAcquired, Value: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locks) != 1 {
+		t.Error("Expected lock to be listed as acquired at the time of the locker clock")
+	}
+}
@@ -2,6 +2,7 @@ package lockheed
 
 import (
 	"fmt"
+	"time"
 )
 
 type Condition struct {
@@ -28,9 +29,13 @@ const (
 )
 
 func (l *Lock) EvaluateSubconditions(c *Condition) (bool, error) {
+	return l.evaluateSubconditions(c, l.clock().Now())
+}
+
+func (l *Lock) evaluateSubconditions(c *Condition, now time.Time) (bool, error) {
 	var results []bool
 	for _, cond := range *c.Conditions {
-		result, err := l.Evaluate(&cond)
+		result, err := l.evaluate(&cond, now)
 		if err != nil {
 			return false, err
 		}
@@ -56,8 +61,13 @@ func (l *Lock) EvaluateSubconditions(c *Condition) (bool, error) {
 }
 
 func (l *Lock) Evaluate(c *Condition) (bool, error) {
+	return l.evaluate(c, l.clock().Now())
+}
+
+// evaluate evaluates the condition against the lock state at given time
+func (l *Lock) evaluate(c *Condition, now time.Time) (bool, error) {
 	if c.Conditions != nil {
-		return l.EvaluateSubconditions(c)
+		return l.evaluateSubconditions(c, now)
 	} else {
 		switch c.Field {
 		case FieldTags:
@@ -75,7 +85,7 @@ func (l *Lock) Evaluate(c *Condition) (bool, error) {
 			case OperationEquals:
 				acquired := false
 				for _, lease := range l.Leases {
-					if !lease.Expired() {
+					if !lease.ExpiredAt(now) && !lease.Pending {
 						acquired = true
 					}
 				}
@@ -0,0 +1,455 @@
+package lockheed
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	kretry "k8s.io/client-go/util/retry"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	CRDGroup   = "lockheed.io"
+	CRDVersion = "v1alpha1"
+	CRDKind    = "Lock"
+	CRDPlural  = "locks"
+)
+
+// LockGVR identifies the Lock custom resource
+var LockGVR = schema.GroupVersionResource{Group: CRDGroup, Version: CRDVersion, Resource: CRDPlural}
+
+// LockResource is the typed representation of a Lock custom resource
+type LockResource struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              LockResourceSpec   `json:"spec"`
+	Status            LockResourceStatus `json:"status,omitempty"`
+}
+
+type LockResourceSpec struct {
+	Type      LockType `json:"type,omitempty"`
+	MaxLeases *int     `json:"maxLeases,omitempty"`
+	Tags      []string `json:"tags,omitempty"`
+}
+
+type LockResourceStatus struct {
+	// Holder lists the active holders separated by commas
+	Holder string `json:"holder,omitempty"`
+	// Expires is the latest expiry of an active lease
+	Expires *metav1.Time  `json:"expires,omitempty"`
+	Leases  []LockLease   `json:"leases,omitempty"`
+	Fence   uint64        `json:"fence,omitempty"`
+	Queue   []QueueTicket `json:"queue,omitempty"`
+	// Transitioned is the last time a lease was granted or dropped
+	Transitioned *metav1.Time `json:"transitioned,omitempty"`
+}
+
+// CRDLocker stores lock state in Lock custom resources named after the lock, with
+// the lock settings in their spec and the leases in their status subresource.
+// The CRD has to be installed beforehand, see LockCRDManifest.
+type CRDLocker struct {
+	Client    dynamic.Interface
+	Namespace string
+	Clock     Clock
+}
+
+func NewCRDLocker(client dynamic.Interface, namespace string) *CRDLocker {
+	locker := &CRDLocker{
+		Client:    client,
+		Namespace: namespace,
+	}
+	return locker
+}
+
+func (locker *CRDLocker) resource() dynamic.ResourceInterface {
+	return locker.Client.Resource(LockGVR).Namespace(locker.Namespace)
+}
+
+func (locker *CRDLocker) GetLockResource(l *Lock) (*unstructured.Unstructured, error) {
+	return locker.resource().Get(l.OperationContext(), l.Name, metav1.GetOptions{})
+}
+
+func (locker *CRDLocker) newLockResource(l *Lock) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion(CRDGroup + "/" + CRDVersion)
+	obj.SetKind(CRDKind)
+	obj.SetName(l.Name)
+	return obj
+}
+
+// decodeLockResource reads the lock state out of the spec and status of a Lock resource
+func decodeLockResource(obj *unstructured.Unstructured) (*Lock, error) {
+	data, err := obj.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	resource := &LockResource{}
+	if err := json.Unmarshal(data, resource); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptState, err)
+	}
+	lockState := &Lock{
+		Name:     resource.Name,
+		LockType: resource.Spec.Type,
+		Fence:    resource.Status.Fence,
+		Queue:    resource.Status.Queue,
+	}
+	if resource.Status.Transitioned != nil {
+		lockState.transition(resource.Status.Transitioned.Time)
+	}
+	lockState.MaxLeases = resource.Spec.MaxLeases
+	lockState.Tags = resource.Spec.Tags
+	if len(resource.Status.Leases) > 0 {
+		lockState.Leases = make(map[string]LockLease)
+		for _, lease := range resource.Status.Leases {
+			lockState.Leases[lease.InstanceID] = lease
+		}
+	}
+	return lockState, nil
+}
+
+func lockResourceSpec(lockState *Lock) LockResourceSpec {
+	return LockResourceSpec{
+		Type:      lockState.LockType,
+		MaxLeases: lockState.MaxLeases,
+		Tags:      lockState.Tags,
+	}
+}
+
+func lockResourceStatus(lockState *Lock, now time.Time) LockResourceStatus {
+	status := LockResourceStatus{
+		Fence: lockState.Fence,
+		Queue: lockState.Queue,
+	}
+	if lockState.Transitioned != nil {
+		transitioned := metav1.NewTime(*lockState.Transitioned)
+		status.Transitioned = &transitioned
+	}
+	var holders []string
+	for key, lease := range lockState.Leases {
+		status.Leases = append(status.Leases, lease)
+		if lease.ExpiredAt(now) || lease.Pending {
+			continue
+		}
+		holders = append(holders, key)
+		if status.Expires == nil || status.Expires.Time.Before(lease.Expires) {
+			expires := metav1.NewTime(lease.Expires)
+			status.Expires = &expires
+		}
+	}
+	sort.Slice(status.Leases, func(i, j int) bool {
+		return status.Leases[i].InstanceID < status.Leases[j].InstanceID
+	})
+	sort.Strings(holders)
+	status.Holder = strings.Join(holders, ",")
+	return status
+}
+
+// setNested stores value as the field of obj, converted through its JSON form
+func setNested(obj *unstructured.Unstructured, value interface{}, field string) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	var converted map[string]interface{}
+	if err := json.Unmarshal(data, &converted); err != nil {
+		return err
+	}
+	return unstructured.SetNestedField(obj.Object, converted, field)
+}
+
+// modify runs a read-modify-write cycle of the lock state stored in the Lock resource,
+// relying on its resourceVersion and retrying on conflicts. Leases are written to the
+// status subresource first, changed settings to the spec afterwards. A missing resource
+// is created only if create is set.
+func (locker *CRDLocker) modify(l *Lock, create bool, fn func(lockState *Lock) error) error {
+	var fnErr error
+	var spec *LockResourceSpec
+	retriable := func(err error) bool {
+		return apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err)
+	}
+	err := kretry.OnError(kretry.DefaultBackoff, retriable, func() error {
+		fnErr, spec = nil, nil
+		obj, err := locker.GetLockResource(l)
+		if apierrors.IsNotFound(err) && create {
+			obj, err = nil, nil
+		}
+		if apierrors.IsNotFound(err) {
+			return fmt.Errorf("Lock %s does not exist: %w", l.Name, ErrLockNotFound)
+		}
+		if err != nil {
+			return err
+		}
+
+		lockState := &Lock{Name: l.Name}
+		if obj != nil {
+			lockState, err = decodeLockResource(obj)
+			if err != nil {
+				return err
+			}
+		}
+		originalSpec, err := json.Marshal(lockResourceSpec(lockState))
+		if err != nil {
+			return err
+		}
+		updated, changed, err := applyChange(lockState, fn)
+		if updated == nil {
+			return err
+		}
+		fnErr = err
+		if obj != nil && !changed {
+			return nil
+		}
+		updatedSpec := lockResourceSpec(lockState)
+		updatedStatus := lockResourceStatus(lockState, l.clock().Now())
+
+		if obj == nil {
+			obj = locker.newLockResource(l)
+			if err := setNested(obj, updatedSpec, "spec"); err != nil {
+				return err
+			}
+			// status is not accepted on creation, it is written right after
+			obj, err = locker.resource().Create(l.OperationContext(), obj, metav1.CreateOptions{})
+			if err != nil {
+				return err
+			}
+		} else if data, err := json.Marshal(updatedSpec); err != nil {
+			return err
+		} else if string(data) != string(originalSpec) {
+			spec = &updatedSpec
+		}
+
+		if err := setNested(obj, updatedStatus, "status"); err != nil {
+			return err
+		}
+		_, err = locker.resource().UpdateStatus(l.OperationContext(), obj, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return kubeConflict(l, err)
+	}
+	if spec != nil {
+		if err := locker.updateSpec(l, *spec); err != nil {
+			return kubeConflict(l, err)
+		}
+	}
+	return fnErr
+}
+
+// updateSpec stores changed lock settings once the leases were written. The settings of l
+// are applied to the spec read on each attempt, so that tags added by others in between are
+// kept, and settings stored first win.
+func (locker *CRDLocker) updateSpec(l *Lock, spec LockResourceSpec) error {
+	return kretry.RetryOnConflict(kretry.DefaultBackoff, func() error {
+		obj, err := locker.GetLockResource(l)
+		if err != nil {
+			return err
+		}
+		stored, err := decodeLockResource(obj)
+		if err != nil {
+			return err
+		}
+		original, err := json.Marshal(lockResourceSpec(stored))
+		if err != nil {
+			return err
+		}
+		if stored.LockType == "" {
+			stored.LockType = spec.Type
+		}
+		if stored.MaxLeases == nil {
+			stored.MaxLeases = spec.MaxLeases
+		}
+		syncLockFields(l, stored)
+		updated := lockResourceSpec(stored)
+		if data, err := json.Marshal(updated); err != nil {
+			return err
+		} else if string(data) == string(original) {
+			return nil
+		}
+		if err := setNested(obj, updated, "spec"); err != nil {
+			return err
+		}
+		_, err = locker.resource().Update(l.OperationContext(), obj, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+func (locker *CRDLocker) GetAllLocks() ([]*Lock, error) {
+	var result []*Lock
+	list, err := locker.resource().List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		return result, err
+	}
+	for i := range list.Items {
+		lockState, err := decodeLockResource(&list.Items[i])
+		if err != nil {
+			return result, err
+		}
+		result = append(result, lockState)
+	}
+	return result, nil
+}
+
+func (locker *CRDLocker) GetLock(name string) (*Lock, error) {
+	obj, err := locker.GetLockResource(&Lock{Name: name, Context: context.Background()})
+	if apierrors.IsNotFound(err) {
+		return nil, fmt.Errorf("Lock %s does not exist: %w", name, ErrLockNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeLockResource(obj)
+}
+
+func (locker *CRDLocker) Acquire(l *Lock) error {
+	return locker.modify(l, true, func(lockState *Lock) error {
+		return lockState.grant(l)
+	})
+}
+
+func (locker *CRDLocker) Renew(l *Lock) error {
+	return locker.modify(l, false, func(lockState *Lock) error {
+		return lockState.renew(l)
+	})
+}
+
+func (locker *CRDLocker) Release(l *Lock) error {
+	return locker.modify(l, false, func(lockState *Lock) error {
+		lockState.release(l)
+		return nil
+	})
+}
+
+// WaitForChange watches the Lock resource and returns as soon as it changes or
+// a lease on the lock expires
+func (locker *CRDLocker) WaitForChange(ctx context.Context, l *Lock) error {
+	obj, err := locker.GetLockResource(l)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	lockState, err := decodeLockResource(obj)
+	if err != nil {
+		return err
+	}
+	opts := metav1.ListOptions{
+		FieldSelector:   fields.OneTermEqualSelector("metadata.name", obj.GetName()).String(),
+		ResourceVersion: obj.GetResourceVersion(),
+	}
+	w, err := locker.resource().Watch(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer w.Stop()
+	return waitForWatchOrExpiry(ctx, w, lockState, l)
+}
+
+// LockCRD returns the CustomResourceDefinition of the Lock resource used by CRDLocker
+func LockCRD() *unstructured.Unstructured {
+	str := map[string]interface{}{"type": "string"}
+	integer := map[string]interface{}{"type": "integer"}
+	date := map[string]interface{}{"type": "string", "format": "date-time"}
+	array := func(items map[string]interface{}) map[string]interface{} {
+		return map[string]interface{}{"type": "array", "items": items}
+	}
+	object := func(properties map[string]interface{}) map[string]interface{} {
+		return map[string]interface{}{"type": "object", "properties": properties}
+	}
+
+	lease := object(map[string]interface{}{
+		"instanceID": str,
+		"expires":    date,
+		"mode":       str,
+		"weight":     integer,
+		"token":      integer,
+		"holds":      integer,
+		"pending":    map[string]interface{}{"type": "boolean"},
+	})
+	ticket := object(map[string]interface{}{
+		"instanceID": str,
+		"expires":    date,
+	})
+	openAPISchema := object(map[string]interface{}{
+		"spec": object(map[string]interface{}{
+			"type": map[string]interface{}{
+				"type": "string",
+				"enum": []interface{}{string(LockTypeMutex), string(LockTypeShared), string(LockTypeSemaphore)},
+			},
+			"maxLeases": map[string]interface{}{"type": "integer", "minimum": int64(1)},
+			"tags":      array(str),
+		}),
+		"status": object(map[string]interface{}{
+			"holder":       str,
+			"expires":      date,
+			"leases":       array(lease),
+			"fence":        integer,
+			"queue":        array(ticket),
+			"transitioned": date,
+		}),
+	})
+	column := func(name, columnType, path string) map[string]interface{} {
+		return map[string]interface{}{"name": name, "type": columnType, "jsonPath": path}
+	}
+
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "apiextensions.k8s.io/v1",
+		"kind":       "CustomResourceDefinition",
+		"metadata": map[string]interface{}{
+			"name": CRDPlural + "." + CRDGroup,
+		},
+		"spec": map[string]interface{}{
+			"group": CRDGroup,
+			"scope": "Namespaced",
+			"names": map[string]interface{}{
+				"plural":   CRDPlural,
+				"singular": strings.ToLower(CRDKind),
+				"kind":     CRDKind,
+				"listKind": CRDKind + "List",
+			},
+			"versions": []interface{}{
+				map[string]interface{}{
+					"name":    CRDVersion,
+					"served":  true,
+					"storage": true,
+					"schema": map[string]interface{}{
+						"openAPIV3Schema": openAPISchema,
+					},
+					"subresources": map[string]interface{}{
+						"status": map[string]interface{}{},
+					},
+					"additionalPrinterColumns": []interface{}{
+						column("Type", "string", ".spec.type"),
+						column("Holder", "string", ".status.holder"),
+						column("Expires", "date", ".status.expires"),
+						column("Age", "date", ".metadata.creationTimestamp"),
+					},
+				},
+			},
+		},
+	}}
+}
+
+// LockCRDManifest returns the YAML manifest of the Lock CustomResourceDefinition,
+// ready to be applied with kubectl
+func LockCRDManifest() ([]byte, error) {
+	data, err := json.Marshal(LockCRD().Object)
+	if err != nil {
+		return nil, err
+	}
+	return yaml.JSONToYAML(data)
+}
+
+func (locker *CRDLocker) clock() Clock {
+	return clockOrReal(locker.Clock)
+}
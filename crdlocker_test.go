@@ -0,0 +1,153 @@
+package lockheed
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"sigs.k8s.io/yaml"
+)
+
+func GetTestCRDLocker() *CRDLocker {
+	return NewCRDLocker(dynamicfake.NewSimpleDynamicClient(runtime.NewScheme()), "default")
+}
+
+func TestCRDLocker(t *testing.T) {
+	locker := GetTestCRDLocker()
+	lockA := NewLock("crdlock", locker).
+		WithDuration(10 * time.Second).
+		WithTags([]string{"testtag"})
+	if err := lockA.Acquire(); err != nil {
+		t.Error(err)
+	}
+	lockB := NewLock("crdlock", locker).WithDuration(10 * time.Second)
+	if err := lockB.Acquire(); err == nil {
+		t.Error("Failure expected")
+	}
+
+	obj, err := locker.GetLockResource(lockA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lockType, _, _ := unstructured.NestedString(obj.Object, "spec", "type")
+	holder, _, _ := unstructured.NestedString(obj.Object, "status", "holder")
+	if lockType != string(LockTypeMutex) || holder != lockA.InstanceID {
+		t.Errorf("Unexpected resource type %q and holder %q", lockType, holder)
+	}
+
+	if err := lockA.Renew(); err != nil {
+		t.Error(err)
+	}
+	status, err := lockA.Describe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.Held || status.Transitioned.IsZero() {
+		t.Errorf("Unexpected status %+v", status)
+	}
+	locks, err := GetLocks(locker, &Condition{Operation: OperationContains, Field: FieldTags, Value: "testtag"})
+	if err != nil {
+		t.Error(err)
+	}
+	if len(locks) != 1 || !locks[0].Leases[lockA.InstanceID].Expires.After(time.Now()) {
+		t.Error("Lock not listed as expected")
+	}
+
+	if err := lockA.Release(); err != nil {
+		t.Error(err)
+	}
+	if err := lockB.Acquire(); err != nil {
+		t.Error(err)
+	}
+	if lockB.FencingToken() != 2 {
+		t.Errorf("Expected fencing token 2, got %d", lockB.FencingToken())
+	}
+	if err := lockB.Release(); err != nil {
+		t.Error(err)
+	}
+	if err := NewLock("missing", locker).Release(); !errors.Is(err, ErrLockNotFound) {
+		t.Errorf("Expected ErrLockNotFound, got %v", err)
+	}
+}
+
+func TestCRDLockerConcurrentTags(t *testing.T) {
+	client := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+	locker := NewCRDLocker(client, "default")
+	lockA := NewLock("tagged", locker).WithDuration(10 * time.Second).WithTags([]string{"a"})
+	if err := lockA.Acquire(); err != nil {
+		t.Fatal(err)
+	}
+	if err := lockA.Release(); err != nil {
+		t.Fatal(err)
+	}
+	// another instance adds its tag between the read and the update of the spec, the
+	// update is refused and the next read returns the spec written by the other instance
+	var concurrent *unstructured.Unstructured
+	conflicted := false
+	client.PrependReactor("get", CRDPlural, func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if concurrent == nil {
+			return false, nil, nil
+		}
+		obj := concurrent
+		concurrent = nil
+		return true, obj, nil
+	})
+	client.PrependReactor("update", CRDPlural, func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "" || conflicted {
+			return false, nil, nil
+		}
+		conflicted = true
+		concurrent = action.(k8stesting.UpdateAction).GetObject().(*unstructured.Unstructured).DeepCopy()
+		unstructured.SetNestedStringSlice(concurrent.Object, []string{"a", "c"}, "spec", "tags")
+		return true, nil, apierrors.NewConflict(schema.GroupResource{Group: CRDGroup, Resource: CRDPlural}, "tagged", errors.New("changed"))
+	})
+
+	if err := NewLock("tagged", locker).WithDuration(10 * time.Second).WithTags([]string{"b"}).Acquire(); err != nil {
+		t.Fatal(err)
+	}
+	lockState, err := locker.GetLock("tagged")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !conflicted || len(lockState.Tags) != 3 {
+		t.Errorf("Expected tags of both writers to be kept, got %v", lockState.Tags)
+	}
+}
+
+func TestCRDLockerSemaphore(t *testing.T) {
+	locker := GetTestCRDLocker()
+	lockA := NewLock("crdsem", locker).WithLockType(LockTypeSemaphore).WithMaxLeases(2).WithDuration(10 * time.Second)
+	lockB := NewLock("crdsem", locker).WithLockType(LockTypeSemaphore).WithMaxLeases(2).WithDuration(10 * time.Second)
+	lockC := NewLock("crdsem", locker).WithLockType(LockTypeSemaphore).WithDuration(10 * time.Second)
+	if err := lockA.Acquire(); err != nil {
+		t.Error(err)
+	}
+	if err := lockB.Acquire(); err != nil {
+		t.Error(err)
+	}
+	if err := lockC.Acquire(); err == nil {
+		t.Error("Expected semaphore to be full")
+	}
+}
+
+func TestLockCRDManifest(t *testing.T) {
+	manifest, err := LockCRDManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	crd := map[string]interface{}{}
+	if err := yaml.Unmarshal(manifest, &crd); err != nil {
+		t.Fatal(err)
+	}
+	name, _, _ := unstructured.NestedString(crd, "metadata", "name")
+	group, _, _ := unstructured.NestedString(crd, "spec", "group")
+	if name != "locks.lockheed.io" || group != CRDGroup {
+		t.Errorf("Unexpected CRD %s of group %s", name, group)
+	}
+}
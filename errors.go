@@ -0,0 +1,85 @@
+package lockheed
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+var (
+	// ErrLockHeld is matched by errors of acquisitions refused because of other holders
+	// or waiters, the details are available through LockHeldError
+	ErrLockHeld = errors.New("lock is held")
+	// ErrLeaseExpired is matched by errors of renewals of a lease that already expired
+	ErrLeaseExpired = errors.New("lease expired")
+	// ErrNotHolder is matched by errors of renewals of a lease not held by the lock instance
+	ErrNotHolder = errors.New("not holding the lock")
+	// ErrCorruptState is matched by errors caused by stored lock state that can not be used
+	ErrCorruptState = errors.New("corrupt lock state")
+	// ErrConflict is matched by errors of operations giving up because the stored lock state
+	// kept being changed by others between reading and storing it
+	ErrConflict = errors.New("lock state kept changing")
+	// ErrLockNotFound is matched by errors of operations on a lock not present in the locker
+	ErrLockNotFound = errors.New("lock not found")
+	// ErrInvalidTransition is matched by errors of operations not allowed in the current state of the lock
+	ErrInvalidTransition = errors.New("invalid lock state transition")
+	// ErrNotInitialized is returned by operations on a lock that was not initialized
+	ErrNotInitialized = errors.New("Lock needs to be properly initialized first")
+)
+
+// LockHeldError reports an acquisition refused because of other holders or waiters of the
+// lock. Errors returned by storage APIs are passed on as they are, so contention can be told
+// apart from any other failure with errors.Is(err, ErrLockHeld).
+type LockHeldError struct {
+	// Name of the lock
+	Name string
+	// InstanceID identifies the holder or waiter which prevented the acquisition,
+	// it is empty if several holders did
+	InstanceID string
+	// Expires is the time the lease or queue ticket of InstanceID expires at
+	Expires time.Time
+	// Tags of the lock
+	Tags []string
+	// Holders lists the leases of all other holders of the lock
+	Holders []LockLease
+	msg     string
+	err     error
+}
+
+func (e *LockHeldError) Error() string {
+	return e.msg
+}
+
+func (e *LockHeldError) Is(target error) bool {
+	return target == ErrLockHeld
+}
+
+func (e *LockHeldError) Unwrap() error {
+	return e.err
+}
+
+// heldError builds the error refusing the acquisition of l because of the lease or queue
+// ticket of instanceID, expiring at given time. With no instanceID given the only other
+// holder of the lock is reported, if there is one.
+func (state *Lock) heldError(l *Lock, instanceID string, expires time.Time, msg string) *LockHeldError {
+	e := &LockHeldError{
+		Name:       state.Name,
+		InstanceID: instanceID,
+		Expires:    expires,
+		Tags:       append([]string(nil), state.Tags...),
+		msg:        msg,
+	}
+	now := l.clock().Now()
+	for key, lease := range state.Leases {
+		if key != l.holderID() && !lease.ExpiredAt(now) {
+			e.Holders = append(e.Holders, lease)
+		}
+	}
+	sort.Slice(e.Holders, func(i, j int) bool {
+		return e.Holders[i].InstanceID < e.Holders[j].InstanceID
+	})
+	if instanceID == "" && len(e.Holders) == 1 {
+		e.InstanceID, e.Expires = e.Holders[0].InstanceID, e.Holders[0].Expires
+	}
+	return e
+}
@@ -0,0 +1,264 @@
+package lockheed
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	// etcdMaxAttempts bounds the number of compare-and-swap attempts of a single operation
+	etcdMaxAttempts = 10
+	// etcdBackoff is the step by which the random delay between attempts grows
+	etcdBackoff = 20 * time.Millisecond
+)
+
+// EtcdLocker stores lock state as JSON under an etcd key, updated by compare-and-swap
+// transactions on its revision. Every holder also owns a key attached to an etcd lease
+// of the lock duration, a lease whose key expired in etcd is considered expired.
+type EtcdLocker struct {
+	Client *clientv3.Client
+	Prefix string
+	Clock  Clock
+}
+
+func NewEtcdLocker(client *clientv3.Client) *EtcdLocker {
+	return &EtcdLocker{
+		Client: client,
+		Prefix: "/lockheed/",
+	}
+}
+
+func (locker *EtcdLocker) GetKey(l *Lock) string {
+	return locker.Prefix + "locks/" + l.Name
+}
+
+func (locker *EtcdLocker) holdersPrefix(name string) string {
+	return locker.Prefix + "holders/" + name + "/"
+}
+
+// reconcileHolders drops active leases from the lock state whose holder key expired in etcd
+func reconcileHolders(lockState *Lock, holders map[string]clientv3.LeaseID) {
+	for key, lease := range lockState.Leases {
+		if _, exists := holders[key]; !exists && !lease.Pending {
+			delete(lockState.Leases, key)
+		}
+	}
+}
+
+// leaseTTL returns the etcd lease TTL for the lock duration, 0 for infinite locks
+func leaseTTL(l *Lock) int64 {
+	if l.Duration == 0 {
+		return 0
+	}
+	return int64(math.Ceil(l.Duration.Seconds()))
+}
+
+// modify runs fn on the state of the lock and writes it back with a transaction
+// conditional on the revision it was read at, retrying after a growing random delay when
+// the key changed in the meantime. The state is written whenever fn changed it, even if fn
+// returned an error. A missing lock is created only if create is set. An etcd lease granted
+// for the holder key is kept across attempts and revoked unless a transaction used it.
+func (locker *EtcdLocker) modify(l *Lock, create bool, fn func(lockState *Lock) error) error {
+	ctx := l.OperationContext()
+	key := locker.GetKey(l)
+	prefix := locker.holdersPrefix(l.Name)
+	granted, grantedUsed, grantedAttempt := clientv3.NoLease, false, 0
+	defer func() {
+		if granted != clientv3.NoLease && !grantedUsed {
+			locker.Client.Revoke(ctx, granted)
+		}
+	}()
+	for attempt := 1; ; attempt++ {
+		resp, err := locker.Client.Txn(ctx).Then(
+			clientv3.OpGet(key),
+			clientv3.OpGet(prefix, clientv3.WithPrefix()),
+		).Commit()
+		if err != nil {
+			return err
+		}
+		stateResp := resp.Responses[0].GetResponseRange()
+		holdersResp := resp.Responses[1].GetResponseRange()
+
+		holders := make(map[string]clientv3.LeaseID)
+		for _, kv := range holdersResp.Kvs {
+			holders[strings.TrimPrefix(string(kv.Key), prefix)] = clientv3.LeaseID(kv.Lease)
+		}
+
+		exists := len(stateResp.Kvs) > 0
+		if !exists && !create {
+			return fmt.Errorf("Lock %s does not exist: %w", l.Name, ErrLockNotFound)
+		}
+		lockState := &Lock{Name: l.Name}
+		revision := int64(0)
+		if exists {
+			revision = stateResp.Kvs[0].ModRevision
+			if err := decodeLockState(stateResp.Kvs[0].Value, lockState); err != nil {
+				return err
+			}
+		}
+		reconcileHolders(lockState, holders)
+
+		updated, changed, fnErr := applyChange(lockState, fn)
+		if updated == nil || (exists && !changed) {
+			return fnErr
+		}
+
+		ops := []clientv3.Op{clientv3.OpPut(key, string(updated))}
+		var revoked []clientv3.LeaseID
+		for holder, leaseID := range holders {
+			if lease, active := lockState.Leases[holder]; !active || lease.Pending {
+				ops = append(ops, clientv3.OpDelete(prefix+holder))
+				if leaseID != clientv3.NoLease {
+					revoked = append(revoked, leaseID)
+				}
+			}
+		}
+		usesGranted := false
+		holder := l.holderID()
+		if lease, active := lockState.Leases[holder]; active && !lease.Pending {
+			leaseID, held := holders[holder]
+			if held && leaseID != clientv3.NoLease {
+				if _, err := locker.Client.KeepAliveOnce(ctx, leaseID); err != nil {
+					return err
+				}
+			} else if ttl := leaseTTL(l); ttl > 0 {
+				if granted == clientv3.NoLease {
+					grant, err := locker.Client.Grant(ctx, ttl)
+					if err != nil {
+						return err
+					}
+					granted, grantedAttempt = grant.ID, attempt
+				}
+				usesGranted = true
+				ops = append(ops, clientv3.OpPut(prefix+holder, l.InstanceID, clientv3.WithLease(granted)))
+			} else if !held {
+				ops = append(ops, clientv3.OpPut(prefix+holder, l.InstanceID))
+			}
+		}
+
+		txn, err := locker.Client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", revision)).
+			Then(ops...).
+			Commit()
+		if err == nil && txn.Succeeded {
+			for _, leaseID := range revoked {
+				locker.Client.Revoke(ctx, leaseID)
+			}
+			if usesGranted {
+				grantedUsed = true
+				// the lease was granted by an earlier attempt, its TTL restarts now
+				if grantedAttempt < attempt {
+					if _, err := locker.Client.KeepAliveOnce(ctx, granted); err != nil {
+						return err
+					}
+				}
+			}
+			return fnErr
+		}
+		if err != nil {
+			return err
+		}
+		if attempt >= etcdMaxAttempts {
+			return fmt.Errorf("Lock %s changed during %d attempts: %w", l.Name, attempt, ErrConflict)
+		}
+		if err := backoffWait(ctx, attempt, etcdBackoff); err != nil {
+			return err
+		}
+	}
+}
+
+func (locker *EtcdLocker) GetAllLocks() ([]*Lock, error) {
+	var result []*Lock
+	ctx := locker.Client.Ctx()
+	resp, err := locker.Client.Txn(ctx).Then(
+		clientv3.OpGet(locker.Prefix+"locks/", clientv3.WithPrefix()),
+		clientv3.OpGet(locker.Prefix+"holders/", clientv3.WithPrefix()),
+	).Commit()
+	if err != nil {
+		return result, err
+	}
+	holders := make(map[string]map[string]clientv3.LeaseID)
+	for _, kv := range resp.Responses[1].GetResponseRange().Kvs {
+		path := strings.TrimPrefix(string(kv.Key), locker.Prefix+"holders/")
+		separator := strings.LastIndex(path, "/")
+		if separator < 0 {
+			continue
+		}
+		name, holder := path[:separator], path[separator+1:]
+		if holders[name] == nil {
+			holders[name] = make(map[string]clientv3.LeaseID)
+		}
+		holders[name][holder] = clientv3.LeaseID(kv.Lease)
+	}
+	for _, kv := range resp.Responses[0].GetResponseRange().Kvs {
+		lockState := &Lock{}
+		if err := decodeLockState(kv.Value, lockState); err != nil {
+			return result, err
+		}
+		reconcileHolders(lockState, holders[lockState.Name])
+		result = append(result, lockState)
+	}
+	return result, nil
+}
+
+func (locker *EtcdLocker) GetLock(name string) (*Lock, error) {
+	l := &Lock{Name: name}
+	prefix := locker.holdersPrefix(name)
+	ctx := locker.Client.Ctx()
+	resp, err := locker.Client.Txn(ctx).Then(
+		clientv3.OpGet(locker.GetKey(l)),
+		clientv3.OpGet(prefix, clientv3.WithPrefix()),
+	).Commit()
+	if err != nil {
+		return nil, err
+	}
+	stateResp := resp.Responses[0].GetResponseRange()
+	if len(stateResp.Kvs) == 0 {
+		return nil, fmt.Errorf("Lock %s does not exist: %w", name, ErrLockNotFound)
+	}
+	holders := make(map[string]clientv3.LeaseID)
+	for _, kv := range resp.Responses[1].GetResponseRange().Kvs {
+		holders[strings.TrimPrefix(string(kv.Key), prefix)] = clientv3.LeaseID(kv.Lease)
+	}
+	lockState := &Lock{Name: name}
+	if err := decodeLockState(stateResp.Kvs[0].Value, lockState); err != nil {
+		return nil, err
+	}
+	reconcileHolders(lockState, holders)
+	return lockState, nil
+}
+
+func (locker *EtcdLocker) Acquire(l *Lock) error {
+	return locker.modify(l, true, func(lockState *Lock) error {
+		return lockState.grant(l)
+	})
+}
+
+func (locker *EtcdLocker) Renew(l *Lock) error {
+	return locker.modify(l, false, func(lockState *Lock) error {
+		return lockState.renew(l)
+	})
+}
+
+// Release keeps retrying while the state keeps changing, as giving up would leave the lease
+// behind until it expires
+func (locker *EtcdLocker) Release(l *Lock) error {
+	for {
+		err := locker.modify(l, false, func(lockState *Lock) error {
+			lockState.release(l)
+			return nil
+		})
+		if !errors.Is(err, ErrConflict) {
+			return err
+		}
+	}
+}
+
+func (locker *EtcdLocker) clock() Clock {
+	return clockOrReal(locker.Clock)
+}
@@ -0,0 +1,185 @@
+package lockheed
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+func freeURL(t *testing.T) url.URL {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	u, _ := url.Parse(fmt.Sprintf("http://%s", listener.Addr().String()))
+	return *u
+}
+
+// StartTestEtcd runs an embedded etcd server and returns a client connected to it
+// along with a function stopping both
+func StartTestEtcd(t *testing.T) (*clientv3.Client, func()) {
+	dir, err := ioutil.TempDir("", "lockheed-etcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := embed.NewConfig()
+	cfg.Dir = dir
+	cfg.LogLevel = "error"
+	clientURL, peerURL := freeURL(t), freeURL(t)
+	cfg.LCUrls, cfg.ACUrls = []url.URL{clientURL}, []url.URL{clientURL}
+	cfg.LPUrls, cfg.APUrls = []url.URL{peerURL}, []url.URL{peerURL}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+	server, err := embed.StartEtcd(cfg)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	select {
+	case <-server.Server.ReadyNotify():
+	case <-time.After(30 * time.Second):
+		server.Close()
+		os.RemoveAll(dir)
+		t.Fatal("Embedded etcd did not start in time")
+	}
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{clientURL.String()},
+		DialTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		server.Close()
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return client, func() {
+		client.Close()
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestEtcdLocker(t *testing.T) {
+	client, stop := StartTestEtcd(t)
+	defer stop()
+	locker := NewEtcdLocker(client)
+
+	lockA := NewLock("testlock", locker).WithDuration(10 * time.Second).WithTags([]string{"testtag"})
+	if err := lockA.Acquire(); err != nil {
+		t.Error(err)
+	}
+	lockB := NewLock("testlock", locker).WithDuration(10 * time.Second)
+	if err := lockB.Acquire(); err == nil {
+		t.Error("Expected to fail")
+	}
+	if err := lockA.Renew(); err != nil {
+		t.Error(err)
+	}
+	lockC := NewLock("testlock2", locker).WithDuration(10 * time.Second).WithTags([]string{"testtag"})
+	if err := lockC.Acquire(); err != nil {
+		t.Error(err)
+	}
+
+	cond := &Condition{
+		Operation: OperationAnd,
+		Conditions: &[]Condition{
+			Condition{Operation: OperationEquals, Field: FieldAcquired, Value: true},
+			Condition{Operation: OperationContains, Field: FieldTags, Value: "testtag"},
+		},
+	}
+	locks, err := GetLocks(locker, cond)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(locks) != 2 {
+		t.Errorf("Expected 2 acquired locks, got %d", len(locks))
+	}
+
+	if err := lockA.Release(); err != nil {
+		t.Error(err)
+	}
+	if err := lockB.Acquire(); err != nil {
+		t.Error(err)
+	}
+	if err := NewLock("missing", locker).Release(); err == nil {
+		t.Error("Expected release of missing lock to fail")
+	}
+}
+
+func TestEtcdLockerLeaseExpiry(t *testing.T) {
+	client, stop := StartTestEtcd(t)
+	defer stop()
+	locker := NewEtcdLocker(client)
+
+	lockA := NewLock("expiring", locker).WithDuration(time.Hour)
+	if err := lockA.Acquire(); err != nil {
+		t.Error(err)
+	}
+	// revoking the etcd lease behind the holder key makes the lease expire, regardless
+	// of the expiry recorded in the lock state
+	resp, err := client.Get(client.Ctx(), locker.holdersPrefix("expiring")+lockA.InstanceID)
+	if err != nil || len(resp.Kvs) != 1 {
+		t.Fatal("Expected holder key to exist")
+	}
+	if _, err := client.Revoke(client.Ctx(), clientv3.LeaseID(resp.Kvs[0].Lease)); err != nil {
+		t.Error(err)
+	}
+	lockB := NewLock("expiring", locker).WithDuration(time.Hour)
+	if err := lockB.Acquire(); err != nil {
+		t.Error(err)
+	}
+	if err := lockA.Renew(); err == nil {
+		t.Error("Expected renewal of expired lease to fail")
+	}
+}
+
+func TestEtcdLockerContention(t *testing.T) {
+	client, stop := StartTestEtcd(t)
+	defer stop()
+	locker := NewEtcdLocker(client)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				lock := NewLock("shared", locker).WithDuration(time.Minute).WithLockType(LockTypeSemaphore).WithMaxLeases(100)
+				// acquisitions might still run out of attempts, releases keep retrying
+				if err := lock.Acquire(); errors.Is(err, ErrConflict) {
+					continue
+				} else if err != nil {
+					t.Error(err)
+					continue
+				}
+				if err := lock.Release(); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	lockState, err := locker.GetLock("shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lockState.Leases) != 0 {
+		t.Errorf("Expected all leases to be released, %d left", len(lockState.Leases))
+	}
+	// etcd leases of lost attempts are not left behind
+	leases, err := client.Leases(client.Ctx())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leases.Leases) != 0 {
+		t.Errorf("Expected no etcd lease left, got %d", len(leases.Leases))
+	}
+}
@@ -1,21 +1,226 @@
 package lockheed
 
-import "fmt"
+import (
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EventCode identifies the kind of an event, 2xx codes report progress, 4xx warnings and 5xx failures
+type EventCode int
+
+const (
+	EventRenewSuccessful   EventCode = 211
+	EventReleaseSuccessful EventCode = 212
+	EventAcquireSuccessful EventCode = 213
+	EventMaintainStarted   EventCode = 214
+	EventMaintainStopped   EventCode = 215
+	EventQueuePosition     EventCode = 217
+	EventStateChanged      EventCode = 218
+	EventDebug             EventCode = 299
+	EventLeaseExpiring     EventCode = 416
+	EventRenewFailed       EventCode = 511
+	EventReleaseFailed     EventCode = 512
+	EventAcquireFailed     EventCode = 513
+	EventLeaseLost         EventCode = 516
+)
+
+// defaultEventBuffer is the number of events buffered for a subscriber unless configured otherwise
+const defaultEventBuffer = 64
 
 type Event struct {
-	Code    int
+	Code    EventCode
 	Message string
 	Err     error
+	// State is the state the lock changed to, set on EventStateChanged only
+	State LockState
+}
+
+// EventHandler is called with every event emitted by a lock, see Lock.WithEventHandler
+type EventHandler func(Event)
+
+// DefaultEventHandler logs events with the standard logger
+func DefaultEventHandler(event Event) {
+	log.Printf("Event: %s\n", event.Message)
+	if event.Err != nil {
+		log.Printf("Error: %s\n", event.Err.Error())
+	}
+}
+
+const (
+	// DropNewest discards the event being delivered when the buffer of a subscriber is full
+	DropNewest DropPolicy = "newest"
+	// DropOldest discards the oldest buffered event to make room for the one being delivered
+	DropOldest DropPolicy = "oldest"
+)
+
+// DropPolicy decides which event is lost when a subscriber does not keep up
+type DropPolicy string
+
+type SubscribeOptions struct {
+	BufferSize int
+	DropPolicy DropPolicy
+}
+
+type SubscribeOption func(opts *SubscribeOptions) error
+
+// SubscribeOptionWithBuffer sets the number of events buffered for the subscriber
+func SubscribeOptionWithBuffer(size int) SubscribeOption {
+	return func(opts *SubscribeOptions) error {
+		if size < 1 {
+			return fmt.Errorf("Event buffer size needs to be positive, got %d", size)
+		}
+		opts.BufferSize = size
+		return nil
+	}
+}
+
+// SubscribeOptionWithDropPolicy sets which events are dropped once the buffer is full, DropNewest by default
+func SubscribeOptionWithDropPolicy(policy DropPolicy) SubscribeOption {
+	return func(opts *SubscribeOptions) error {
+		if policy != DropNewest && policy != DropOldest {
+			return fmt.Errorf("Unknown drop policy %q", policy)
+		}
+		opts.DropPolicy = policy
+		return nil
+	}
+}
+
+// Subscription receives the events emitted by a lock on its channel C until closed
+type Subscription struct {
+	C       <-chan Event
+	events  chan Event
+	policy  DropPolicy
+	bus     *eventBus
+	dropped uint64
+}
+
+// Dropped returns the number of events the subscriber missed because its buffer was full
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Close stops the delivery of events and closes C
+func (s *Subscription) Close() {
+	s.bus.unsubscribe(s)
 }
 
+// deliver hands e over to the subscriber without blocking, applying the drop policy if
+// the buffer is full. It is only called with the bus mutex held.
+func (s *Subscription) deliver(e Event) {
+	select {
+	case s.events <- e:
+		return
+	default:
+	}
+	if s.policy == DropOldest {
+		select {
+		case <-s.events:
+		default:
+		}
+		select {
+		case s.events <- e:
+		default:
+		}
+	}
+	atomic.AddUint64(&s.dropped, 1)
+}
+
+// eventBus fans out events of a lock to all of its subscribers
+type eventBus struct {
+	mutex       sync.Mutex
+	subscribers []*Subscription
+}
+
+func (bus *eventBus) subscribe(opts SubscribeOptions) *Subscription {
+	events := make(chan Event, opts.BufferSize)
+	s := &Subscription{C: events, events: events, policy: opts.DropPolicy, bus: bus}
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	bus.subscribers = append(bus.subscribers, s)
+	return s
+}
+
+func (bus *eventBus) unsubscribe(s *Subscription) {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	for i, subscriber := range bus.subscribers {
+		if subscriber == s {
+			bus.subscribers = append(bus.subscribers[:i], bus.subscribers[i+1:]...)
+			close(s.events)
+			return
+		}
+	}
+}
+
+func (bus *eventBus) publish(e Event) {
+	if bus == nil {
+		return
+	}
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	for _, s := range bus.subscribers {
+		s.deliver(e)
+	}
+}
+
+// Subscribe registers a new receiver of the events emitted by the lock. Events are
+// never waited for, once the buffer of the subscription is full they get dropped
+// according to its drop policy. The subscription needs to be closed when no longer used.
+func (l *Lock) Subscribe(opts ...SubscribeOption) (*Subscription, error) {
+	so := SubscribeOptions{BufferSize: defaultEventBuffer, DropPolicy: DropNewest}
+	for _, opt := range opts {
+		if err := opt(&so); err != nil {
+			return nil, err
+		}
+	}
+	if l.events == nil {
+		return nil, ErrNotInitialized
+	}
+	return l.events.subscribe(so), nil
+}
+
+// WithEventHandler replaces the handler called with the events of the lock, DefaultEventHandler
+// unless set. The handler runs in its own goroutine until the lock context is done, nil disables it.
+func (l *Lock) WithEventHandler(handler EventHandler) *Lock {
+	if l.handler != nil {
+		l.handler.Close()
+		l.handler = nil
+	}
+	if handler == nil || l.events == nil {
+		return l
+	}
+	s, _ := l.Subscribe()
+	l.handler = s
+	ctx := l.Context
+	go func() {
+		defer s.Close()
+		for {
+			select {
+			case event, ok := <-s.C:
+				if !ok {
+					return
+				}
+				handler(event)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return l
+}
+
+// Emit delivers e to the subscribers of the lock without blocking and returns its error
 func (l *Lock) Emit(e Event) error {
-	l.eventChan <- e
+	l.events.publish(e)
 	return e.Err
 }
 
 func (l *Lock) EmitRenewSuccessful() {
 	l.Emit(Event{
-		Code:    211,
+		Code:    EventRenewSuccessful,
 		Message: fmt.Sprintf("Lock %s(%s) renewal successful", l.Name, l.InstanceID),
 		Err:     nil,
 	})
@@ -23,7 +228,7 @@ func (l *Lock) EmitRenewSuccessful() {
 
 func (l *Lock) EmitRenewFailed(err error) {
 	l.Emit(Event{
-		Code:    511,
+		Code:    EventRenewFailed,
 		Message: fmt.Sprintf("Lock %s(%s) renewal failed", l.Name, l.InstanceID),
 		Err:     err,
 	})
@@ -31,7 +236,7 @@ func (l *Lock) EmitRenewFailed(err error) {
 
 func (l *Lock) EmitReleaseSuccessful() {
 	l.Emit(Event{
-		Code:    212,
+		Code:    EventReleaseSuccessful,
 		Message: fmt.Sprintf("Lock %s(%s) release successful", l.Name, l.InstanceID),
 		Err:     nil,
 	})
@@ -39,7 +244,7 @@ func (l *Lock) EmitReleaseSuccessful() {
 
 func (l *Lock) EmitReleaseFailed(err error) {
 	l.Emit(Event{
-		Code:    512,
+		Code:    EventReleaseFailed,
 		Message: fmt.Sprintf("Lock %s(%s) release failed", l.Name, l.InstanceID),
 		Err:     err,
 	})
@@ -47,7 +252,7 @@ func (l *Lock) EmitReleaseFailed(err error) {
 
 func (l *Lock) EmitAcquireSuccessful() {
 	l.Emit(Event{
-		Code:    213,
+		Code:    EventAcquireSuccessful,
 		Message: fmt.Sprintf("Lock %s(%s) acquire successful", l.Name, l.InstanceID),
 		Err:     nil,
 	})
@@ -55,7 +260,7 @@ func (l *Lock) EmitAcquireSuccessful() {
 
 func (l *Lock) EmitAcquireFailed(err error) {
 	l.Emit(Event{
-		Code:    513,
+		Code:    EventAcquireFailed,
 		Message: fmt.Sprintf("Lock %s(%s) acquire failed", l.Name, l.InstanceID),
 		Err:     err,
 	})
@@ -63,7 +268,7 @@ func (l *Lock) EmitAcquireFailed(err error) {
 
 func (l *Lock) EmitMaintainStarted() {
 	l.Emit(Event{
-		Code:    214,
+		Code:    EventMaintainStarted,
 		Message: fmt.Sprintf("Lock %s(%s) maintain loop started", l.Name, l.InstanceID),
 		Err:     nil,
 	})
@@ -71,15 +276,48 @@ func (l *Lock) EmitMaintainStarted() {
 
 func (l *Lock) EmitMaintainStopped() {
 	l.Emit(Event{
-		Code:    215,
+		Code:    EventMaintainStopped,
 		Message: fmt.Sprintf("Lock %s(%s) maintain loop stopped", l.Name, l.InstanceID),
 		Err:     nil,
 	})
 }
 
+func (l *Lock) EmitLeaseExpiring(remaining time.Duration) {
+	l.Emit(Event{
+		Code:    EventLeaseExpiring,
+		Message: fmt.Sprintf("Lock %s(%s) lease expires in %s unless renewed", l.Name, l.InstanceID, remaining),
+		Err:     nil,
+	})
+}
+
+func (l *Lock) EmitLeaseLost(err error) {
+	l.Emit(Event{
+		Code:    EventLeaseLost,
+		Message: fmt.Sprintf("Lock %s(%s) lease lost", l.Name, l.InstanceID),
+		Err:     err,
+	})
+}
+
+func (l *Lock) EmitQueuePosition(position int) {
+	l.Emit(Event{
+		Code:    EventQueuePosition,
+		Message: fmt.Sprintf("Lock %s(%s) waiting in queue at position %d", l.Name, l.InstanceID, position),
+		Err:     nil,
+	})
+}
+
+func (l *Lock) EmitStateChanged(from LockState, to LockState) {
+	l.Emit(Event{
+		Code:    EventStateChanged,
+		Message: fmt.Sprintf("Lock %s(%s) state changed from %s to %s", l.Name, l.InstanceID, from, to),
+		Err:     nil,
+		State:   to,
+	})
+}
+
 func (l *Lock) EmitDebug(msg string) {
 	l.Emit(Event{
-		Code:    299,
+		Code:    EventDebug,
 		Message: fmt.Sprintf("Lock %s(%s) debug: %s", l.Name, l.InstanceID, msg),
 		Err:     nil,
 	})
@@ -0,0 +1,122 @@
+package lockheed
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEmitAfterCancel(t *testing.T) {
+	lock := NewLock("cancelled", &stubLocker{})
+	lock.Cancel()
+	done := make(chan struct{})
+	go func() {
+		lock.EmitMaintainStopped()
+		lock.EmitDebug("still not blocking")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("Expected emit not to block after cancel")
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	lock := NewLock("subscribed", &stubLocker{}).WithEventHandler(nil)
+	first, err := lock.Subscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := lock.Subscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lock.Acquire(); err != nil {
+		t.Error(err)
+	}
+	for _, s := range []*Subscription{first, second} {
+		event, ok := nextEvent(s.C)
+		if !ok {
+			t.Error("Expected event to be delivered to every subscriber")
+		} else if event.Code != EventAcquireSuccessful {
+			t.Errorf("Unexpected event %d", event.Code)
+		}
+	}
+
+	second.Close()
+	if _, open := <-second.C; open {
+		t.Error("Expected channel to be closed")
+	}
+	lock.Release()
+	if event, _ := nextEvent(first.C); event.Code != EventReleaseSuccessful {
+		t.Errorf("Unexpected event %d", event.Code)
+	}
+	first.Close()
+}
+
+func TestSubscribeDropPolicy(t *testing.T) {
+	lock := NewLock("dropping", &stubLocker{}).WithEventHandler(nil)
+	newest, err := lock.Subscribe(SubscribeOptionWithBuffer(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldest, err := lock.Subscribe(SubscribeOptionWithBuffer(2), SubscribeOptionWithDropPolicy(DropOldest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		lock.EmitQueuePosition(i)
+	}
+	if newest.Dropped() != 1 || oldest.Dropped() != 1 {
+		t.Error("Expected one dropped event per subscriber")
+	}
+	if event := <-newest.C; event.Message != "Lock dropping("+lock.InstanceID+") waiting in queue at position 1" {
+		t.Errorf("Expected newest event to be dropped, got %s", event.Message)
+	}
+	if event := <-oldest.C; event.Message != "Lock dropping("+lock.InstanceID+") waiting in queue at position 2" {
+		t.Errorf("Expected oldest event to be dropped, got %s", event.Message)
+	}
+
+	if _, err := lock.Subscribe(SubscribeOptionWithDropPolicy("random")); err == nil {
+		t.Error("Expected unknown drop policy to be rejected")
+	}
+}
+
+func TestWithEventHandler(t *testing.T) {
+	received := make(chan Event, 10)
+	lock := NewLock("handled", &stubLocker{}).WithEventHandler(func(e Event) {
+		received <- e
+	})
+	lock.Acquire()
+	for {
+		select {
+		case event := <-received:
+			if event.Code == EventStateChanged {
+				continue
+			}
+			if event.Code != EventAcquireSuccessful {
+				t.Errorf("Unexpected event %d", event.Code)
+			}
+		case <-time.After(time.Second):
+			t.Error("Expected handler to be called")
+		}
+		return
+	}
+}
+
+// nextEvent returns the first event already buffered in c which does not report a state change
+func nextEvent(c <-chan Event) (Event, bool) {
+	for {
+		select {
+		case event, ok := <-c:
+			if !ok {
+				return event, false
+			}
+			if event.Code != EventStateChanged {
+				return event, true
+			}
+		default:
+			return Event{}, false
+		}
+	}
+}
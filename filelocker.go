@@ -0,0 +1,190 @@
+package lockheed
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	fileLockerStateSuffix = ".json"
+	fileLockerLockSuffix  = ".lock"
+)
+
+// FileLocker stores the state of every lock as JSON in its own file within a directory,
+// which can be shared between hosts on a network volume. Updates are serialized by an OS
+// advisory lock on a companion lock file and written by an atomic rename.
+type FileLocker struct {
+	Dir   string
+	Clock Clock
+}
+
+func NewFileLocker(dir string) *FileLocker {
+	return &FileLocker{Dir: dir}
+}
+
+func (locker *FileLocker) GetFileName(l *Lock) string {
+	return filepath.Join(locker.Dir, l.Name+fileLockerStateSuffix)
+}
+
+func (locker *FileLocker) getLockFileName(l *Lock) string {
+	return filepath.Join(locker.Dir, l.Name+fileLockerLockSuffix)
+}
+
+// readState reads the lock state from path, returning nil state if the file does not exist
+func readState(path string) (*Lock, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	lockState := &Lock{}
+	if err := decodeLockState(data, lockState); err != nil {
+		return nil, fmt.Errorf("Error reading lock state from %s: %w", path, err)
+	}
+	return lockState, nil
+}
+
+// writeState replaces the lock state in path atomically
+func writeState(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// modify runs fn on the state of the lock while holding an exclusive advisory lock on
+// the lock file. A missing lock is created only if create is set.
+func (locker *FileLocker) modify(l *Lock, create bool, fn func(lockState *Lock) error) error {
+	if l.Name == "" || strings.ContainsAny(l.Name, `/\`) {
+		return fmt.Errorf("Invalid lock name %q", l.Name)
+	}
+	if create {
+		if err := os.MkdirAll(locker.Dir, 0755); err != nil {
+			return err
+		}
+	}
+	path := locker.GetFileName(l)
+	if !create {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return fmt.Errorf("Lock %s does not exist: %w", l.Name, ErrLockNotFound)
+		} else if err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(locker.getLockFileName(l), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := lockFile(f); err != nil {
+		return fmt.Errorf("Error locking %s: %w", f.Name(), err)
+	}
+	defer unlockFile(f)
+
+	lockState, err := readState(path)
+	if err != nil {
+		return err
+	}
+	exists := lockState != nil
+	if !exists {
+		if !create {
+			return fmt.Errorf("Lock %s does not exist: %w", l.Name, ErrLockNotFound)
+		}
+		lockState = &Lock{Name: l.Name}
+	}
+
+	updated, changed, err := applyChange(lockState, fn)
+	if updated != nil && (!exists || changed) {
+		if err := writeState(path, updated); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func (locker *FileLocker) GetAllLocks() ([]*Lock, error) {
+	var result []*Lock
+	entries, err := ioutil.ReadDir(locker.Dir)
+	if os.IsNotExist(err) {
+		return result, nil
+	}
+	if err != nil {
+		return result, err
+	}
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, fileLockerStateSuffix) {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		lockState, err := readState(filepath.Join(locker.Dir, name))
+		if err != nil {
+			return result, err
+		}
+		if lockState != nil {
+			result = append(result, lockState)
+		}
+	}
+	return result, nil
+}
+
+func (locker *FileLocker) GetLock(name string) (*Lock, error) {
+	if name == "" || strings.ContainsAny(name, `/\`) {
+		return nil, fmt.Errorf("Invalid lock name %q", name)
+	}
+	lockState, err := readState(locker.GetFileName(&Lock{Name: name}))
+	if err != nil {
+		return nil, err
+	}
+	if lockState == nil {
+		return nil, fmt.Errorf("Lock %s does not exist: %w", name, ErrLockNotFound)
+	}
+	return lockState, nil
+}
+
+func (locker *FileLocker) Acquire(l *Lock) error {
+	return locker.modify(l, true, func(lockState *Lock) error {
+		return lockState.grant(l)
+	})
+}
+
+func (locker *FileLocker) Renew(l *Lock) error {
+	return locker.modify(l, false, func(lockState *Lock) error {
+		return lockState.renew(l)
+	})
+}
+
+func (locker *FileLocker) Release(l *Lock) error {
+	return locker.modify(l, false, func(lockState *Lock) error {
+		lockState.release(l)
+		return nil
+	})
+}
+
+func (locker *FileLocker) clock() Clock {
+	return clockOrReal(locker.Clock)
+}
@@ -0,0 +1,81 @@
+package lockheed
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func GetTestFileLocker(t *testing.T) *FileLocker {
+	dir, err := ioutil.TempDir("", "lockheed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewFileLocker(filepath.Join(dir, "locks"))
+}
+
+func TestFileLocker(t *testing.T) {
+	locker := GetTestFileLocker(t)
+	defer os.RemoveAll(filepath.Dir(locker.Dir))
+	lockA := NewLock("testlock", locker).WithDuration(10 * time.Second).WithTags([]string{"testtag"})
+	if err := lockA.Acquire(); err != nil {
+		t.Error(err)
+	}
+	lockB := NewLock("testlock", NewFileLocker(locker.Dir)).WithDuration(10 * time.Second)
+	if err := lockB.Acquire(); err == nil {
+		t.Error("Expected to fail")
+	}
+	lockC := NewLock("testlock2", locker).WithDuration(50 * time.Millisecond).WithTags([]string{"testtag"})
+	if err := lockC.Acquire(); err != nil {
+		t.Error(err)
+	}
+
+	cond := &Condition{Operation: OperationContains, Field: FieldTags, Value: "testtag"}
+	locks, err := GetLocks(locker, cond)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(locks) != 2 || locks[0].Name != "testlock" || locks[1].Name != "testlock2" {
+		t.Error("Locks not listed as expected")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if err := lockC.Renew(); err == nil {
+		t.Error("Expected renewal of expired lease to fail")
+	}
+	if err := lockA.Release(); err != nil {
+		t.Error(err)
+	}
+	if err := lockB.Acquire(); err != nil {
+		t.Error(err)
+	}
+	if err := NewLock("missing", locker).Release(); !errors.Is(err, ErrLockNotFound) {
+		t.Errorf("Expected ErrLockNotFound, got %v", err)
+	}
+}
+
+func TestFileLockerConcurrency(t *testing.T) {
+	locker := GetTestFileLocker(t)
+	defer os.RemoveAll(filepath.Dir(locker.Dir))
+	var wg sync.WaitGroup
+	acquired := make(chan string, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lock := NewLock("contended", NewFileLocker(locker.Dir)).WithDuration(time.Minute)
+			if err := lock.Acquire(); err == nil {
+				acquired <- lock.InstanceID
+			}
+		}()
+	}
+	wg.Wait()
+	close(acquired)
+	if len(acquired) != 1 {
+		t.Errorf("Expected exactly one holder, got %d", len(acquired))
+	}
+}
@@ -3,14 +3,16 @@ module github.com/goblain/lockheed
 go 1.13
 
 require (
-	github.com/goblain/go-retry v0.0.0-20221205140251-4ffabb57e5da // indirect
-	github.com/golang/protobuf v1.4.2 // indirect
-	github.com/google/uuid v1.1.1
-	golang.org/x/crypto v0.0.0-20200709230013-948cd5f35899 // indirect
-	golang.org/x/net v0.0.0-20200707034311-ab3426394381 // indirect
-	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d // indirect
-	golang.org/x/time v0.0.0-20200630173020-3af7569d3a1e // indirect
+	github.com/alicebob/miniredis/v2 v2.14.3
+	github.com/go-redis/redis/v8 v8.11.5
+	github.com/goblain/go-retry v0.0.0-20221205140251-4ffabb57e5da
+	github.com/google/uuid v1.1.2
+	github.com/mattn/go-sqlite3 v1.14.16
+	go.etcd.io/etcd/client/v3 v3.5.5
+	go.etcd.io/etcd/server/v3 v3.5.5
+	golang.org/x/sys v0.0.0-20211216021012-1d35b9e2eb4e
 	k8s.io/api v0.18.6
 	k8s.io/apimachinery v0.18.6
 	k8s.io/client-go v0.18.6
+	sigs.k8s.io/yaml v1.2.0
 )
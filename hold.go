@@ -0,0 +1,179 @@
+package lockheed
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// hold tracks a single period of time during which the lock is held by this instance
+type hold struct {
+	ctx    context.Context
+	cancel func()
+	lost   chan struct{}
+	until  time.Time
+	// stop cancels the local expiry of the hold
+	stop  func() bool
+	ended bool
+	// count of reentrant acquisitions through this lock instance
+	count int
+	// maintained is set once a Maintain loop runs for the hold
+	maintained bool
+}
+
+// initHold sets up an already ended hold, so that HeldContext is done until the lock is acquired
+func (l *Lock) initHold() {
+	ctx, cancel := context.WithCancel(l.Context)
+	cancel()
+	l.hold = &hold{ctx: ctx, cancel: cancel, lost: make(chan struct{}), ended: true}
+}
+
+// Lost returns a channel that is closed when the lease of the current hold of the lock
+// is lost, because renewal failed definitively, the lease expired or was taken over
+func (l *Lock) Lost() <-chan struct{} {
+	l.holdMutex.Lock()
+	defer l.holdMutex.Unlock()
+	return l.hold.lost
+}
+
+// HeldContext returns a context that is cancelled when the current hold of the lock ends,
+// either by losing the lease or by releasing it
+func (l *Lock) HeldContext() context.Context {
+	l.holdMutex.Lock()
+	defer l.holdMutex.Unlock()
+	return l.hold.ctx
+}
+
+// FencingToken returns the token issued with the lease of this instance. Tokens grow with
+// every acquisition of the lock, so systems protected by it can reject requests carrying
+// a token lower than one they have already seen. The value is meaningful only while held.
+func (l *Lock) FencingToken() uint64 {
+	l.holdMutex.Lock()
+	defer l.holdMutex.Unlock()
+	return l.fencingToken
+}
+
+func (l *Lock) setFencingToken(token uint64) {
+	l.holdMutex.Lock()
+	defer l.holdMutex.Unlock()
+	l.fencingToken = token
+}
+
+func (l *Lock) setQueuePosition(position int) {
+	l.holdMutex.Lock()
+	defer l.holdMutex.Unlock()
+	l.waiterPosition = position
+}
+
+// startHold begins a new hold, or extends the current one, after a lease was
+// successfully written by an attempt started at given time
+func (l *Lock) startHold(started time.Time) {
+	l.holdMutex.Lock()
+	defer l.holdMutex.Unlock()
+	if l.hold.ended {
+		ctx, cancel := context.WithCancel(l.Context)
+		l.hold = &hold{ctx: ctx, cancel: cancel, lost: make(chan struct{})}
+	}
+	if l.Reentrant || l.hold.count == 0 {
+		l.hold.count++
+	}
+	l.extendHoldLocked(started)
+}
+
+// extendHold moves the local expiry of the current hold after a successful renewal
+func (l *Lock) extendHold(started time.Time) {
+	l.holdMutex.Lock()
+	defer l.holdMutex.Unlock()
+	if !l.hold.ended {
+		l.extendHoldLocked(started)
+	}
+}
+
+func (l *Lock) extendHoldLocked(started time.Time) {
+	h := l.hold
+	if h.stop != nil {
+		h.stop()
+	}
+	if l.Duration == 0 {
+		h.until = time.Time{}
+		return
+	}
+	h.until = started.Add(l.Duration)
+	h.stop = l.clock().AfterFunc(h.until.Sub(l.clock().Now()), func() {
+		l.loseHold(h, fmt.Errorf("Lease on lock %s for %s expired locally", l.Name, l.InstanceID))
+	})
+}
+
+// isHeld reports whether this lock instance currently holds the lock
+func (l *Lock) isHeld() bool {
+	l.holdMutex.Lock()
+	defer l.holdMutex.Unlock()
+	return !l.hold.ended
+}
+
+// endHold finishes the current hold on release, once all reentrant acquisitions are released.
+// It reports whether the release ends the hold, or whether there was no hold to end.
+func (l *Lock) endHold() bool {
+	l.holdMutex.Lock()
+	defer l.holdMutex.Unlock()
+	if l.hold.count > 1 {
+		l.hold.count--
+		return false
+	}
+	l.endHoldLocked(l.hold)
+	return true
+}
+
+// claimMaintain marks the current hold as maintained and returns its context,
+// unless the hold ended or is maintained already
+func (l *Lock) claimMaintain() (context.Context, bool) {
+	l.holdMutex.Lock()
+	defer l.holdMutex.Unlock()
+	if l.hold.ended || l.hold.maintained {
+		return nil, false
+	}
+	l.hold.maintained = true
+	return l.hold.ctx, true
+}
+
+func (l *Lock) endHoldLocked(h *hold) {
+	if h.stop != nil {
+		h.stop()
+	}
+	h.ended = true
+	h.cancel()
+}
+
+// loseHold marks the hold h as lost, unless it already ended
+func (l *Lock) loseHold(h *hold, err error) {
+	l.holdMutex.Lock()
+	if h != l.hold || h.ended {
+		l.holdMutex.Unlock()
+		return
+	}
+	l.endHoldLocked(h)
+	close(h.lost)
+	from := l.lifecycle
+	lost := (from == LockStateHeld || from == LockStateRenewing) && l.setStateLocked(LockStateLost) == nil
+	l.holdMutex.Unlock()
+	if lost {
+		l.EmitStateChanged(from, LockStateLost)
+	}
+	l.EmitLeaseLost(err)
+}
+
+// checkRenewFailure decides whether a failed renewal means the hold is lost,
+// or warns that the lease is going to expire unless a following renewal succeeds
+func (l *Lock) checkRenewFailure(err error) {
+	l.holdMutex.Lock()
+	h := l.hold
+	until := h.until
+	l.holdMutex.Unlock()
+	if isLeaseLost(err) {
+		l.loseHold(h, err)
+		return
+	}
+	if !until.IsZero() {
+		l.EmitLeaseExpiring(until.Sub(l.clock().Now()))
+	}
+}
@@ -3,6 +3,7 @@ package lockheed
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
@@ -10,19 +11,32 @@ import (
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	kretry "k8s.io/client-go/util/retry"
 )
 
+const (
+	// reservation annotations used by older versions of KubeLocker, still honored during upgrades
+	legacyReservedByAnnotation      = "reserved/by"
+	legacyReservedExpiresAnnotation = "reserved/expires"
+)
+
+var errLegacyReservation = errors.New("legacy reservation in place")
+
 type KubeLocker struct {
-	Clientset *kubernetes.Clientset
+	Clientset kubernetes.Interface
 	Namespace string
 	Prefix    string
+	Clock     Clock
 }
 
-func NewKubeLocker(cset *kubernetes.Clientset, namespace string) *KubeLocker {
+func NewKubeLocker(cset kubernetes.Interface, namespace string) *KubeLocker {
 	lock := &KubeLocker{
 		Clientset: cset,
 		Namespace: namespace,
@@ -36,38 +50,36 @@ func (locker *KubeLocker) GetConfigMapName(l *Lock) string {
 }
 
 func (locker *KubeLocker) ConfigMapExists(l *Lock) (bool, error) {
-	name := locker.GetConfigMapName(l)
-	list, err := locker.Clientset.CoreV1().ConfigMaps(locker.Namespace).List(l.Context, metav1.ListOptions{})
+	_, err := locker.GetConfigMap(l)
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
 	if err != nil {
 		return false, err
 	}
-	found := false
-	for _, item := range list.Items {
-		if item.Name == name {
-			found = true
-			break
-		}
-	}
-	return found, nil
+	return true, nil
 }
 
-func (locker *KubeLocker) CreateNewConfigMap(l *Lock) error {
-	lockStateJson, err := json.Marshal(l)
-	if err != nil {
-		return err
-	}
-	cmap := &corev1.ConfigMap{
+func (locker *KubeLocker) newConfigMap(l *Lock) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
 			Name: locker.GetConfigMapName(l),
 			Labels: map[string]string{
 				"lockheed/lock": "",
 			},
 		},
-		Data: map[string]string{
-			"lock": string(lockStateJson),
-		},
+		Data: map[string]string{},
+	}
+}
+
+func (locker *KubeLocker) CreateNewConfigMap(l *Lock) error {
+	lockStateJson, err := json.Marshal(l)
+	if err != nil {
+		return err
 	}
-	_, err = locker.Clientset.CoreV1().ConfigMaps(locker.Namespace).Create(l.Context, cmap, metav1.CreateOptions{})
+	cmap := locker.newConfigMap(l)
+	cmap.Data["lock"] = string(lockStateJson)
+	_, err = locker.Clientset.CoreV1().ConfigMaps(locker.Namespace).Create(l.OperationContext(), cmap, metav1.CreateOptions{})
 	if err != nil {
 		return err
 	}
@@ -80,84 +92,114 @@ func (locker *KubeLocker) Init(l *Lock) error {
 		return err
 	}
 	if !exists {
-		return locker.CreateNewConfigMap(l)
+		err = locker.CreateNewConfigMap(l)
+		if apierrors.IsAlreadyExists(err) {
+			return nil
+		}
+		return err
 	}
 	return nil
 }
 
 func (locker *KubeLocker) GetConfigMap(l *Lock) (*corev1.ConfigMap, error) {
 	name := locker.GetConfigMapName(l)
-	cmap, err := locker.Clientset.CoreV1().ConfigMaps(locker.Namespace).Get(l.Context, name, metav1.GetOptions{})
+	cmap, err := locker.Clientset.CoreV1().ConfigMaps(locker.Namespace).Get(l.OperationContext(), name, metav1.GetOptions{})
 	if err != nil {
 		return nil, err
 	}
 	return cmap, nil
 }
 
-func (locker *KubeLocker) GetReservedConfigMap(l *Lock) (*corev1.ConfigMap, error) {
-	attempt := 0
-	for {
-		attempt++
-		cmap, err := locker.GetReservedConfigMapAttempt(l)
-		if err == nil {
-			return cmap, nil
-		}
-		if attempt >= 5 {
-			return cmap, err
+// checkLegacyReservation honors the reservation annotations set by older versions of
+// KubeLocker and drops them from the ConfigMap once they expired
+func (locker *KubeLocker) checkLegacyReservation(cmap *corev1.ConfigMap, now time.Time) error {
+	by, reserved := cmap.ObjectMeta.Annotations[legacyReservedByAnnotation]
+	if !reserved {
+		return nil
+	}
+	expires, err := time.Parse(time.RFC3339, cmap.ObjectMeta.Annotations[legacyReservedExpiresAnnotation])
+	if err == nil && now.Before(expires) {
+		return &LockHeldError{
+			Name:       cmap.Name,
+			InstanceID: by,
+			Expires:    expires,
+			msg:        fmt.Sprintf("ConfigMap %s reserved by %s", cmap.Name, by),
+			err:        errLegacyReservation,
 		}
-		time.Sleep(time.Second)
 	}
+	delete(cmap.ObjectMeta.Annotations, legacyReservedByAnnotation)
+	delete(cmap.ObjectMeta.Annotations, legacyReservedExpiresAnnotation)
+	return nil
 }
 
-func (locker *KubeLocker) GetReservedConfigMapAttempt(l *Lock) (*corev1.ConfigMap, error) {
-	name := locker.GetConfigMapName(l)
-	cmap, err := locker.GetConfigMap(l)
-	if err != nil {
-		return nil, err
+// kubeConflict reports err as ErrConflict if the writes of l still conflicted once
+// kretry.DefaultBackoff ran out
+func kubeConflict(l *Lock, err error) error {
+	if apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("Lock %s changed during %d attempts: %w", l.Name, kretry.DefaultBackoff.Steps, ErrConflict)
 	}
-	if val, reserved := cmap.ObjectMeta.Annotations["reserved/by"]; reserved {
-		expires, err := time.Parse(time.RFC3339, cmap.ObjectMeta.Annotations["reserved/expires"])
+	return err
+}
+
+// modify runs a single read-modify-write cycle of the lock state stored in the ConfigMap,
+// relying on its resourceVersion and retrying on conflicts. A missing ConfigMap is
+// created only if create is set.
+func (locker *KubeLocker) modify(l *Lock, create bool, fn func(lockState *Lock) error) error {
+	var fnErr error
+	retriable := func(err error) bool {
+		return apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err) || errors.Is(err, errLegacyReservation)
+	}
+	err := kretry.OnError(kretry.DefaultBackoff, retriable, func() error {
+		fnErr = nil
+		cmap, err := locker.GetConfigMap(l)
+		if apierrors.IsNotFound(err) && create {
+			cmap, err = nil, nil
+		}
+		if apierrors.IsNotFound(err) {
+			return fmt.Errorf("Lock %s does not exist: %w", l.Name, ErrLockNotFound)
+		}
 		if err != nil {
-			return nil, err
+			return err
 		}
-		if time.Now().Before(expires) {
-			return nil, fmt.Errorf("ConfigMap %s reserved by %s", name, val)
+
+		lockState := &Lock{Name: l.Name}
+		if cmap != nil {
+			if err := locker.checkLegacyReservation(cmap, l.clock().Now()); err != nil {
+				return err
+			}
+			if data, exists := cmap.Data["lock"]; exists {
+				if err := decodeLockState([]byte(data), lockState); err != nil {
+					return err
+				}
+			}
 		}
-	}
-	if cmap.ObjectMeta.Annotations == nil {
-		cmap.ObjectMeta.Annotations = make(map[string]string)
-	}
-	cmap.ObjectMeta.Annotations["reserved/by"] = l.InstanceID
-	cmap.ObjectMeta.Annotations["reserved/expires"] = time.Now().Add(30 * time.Second).Format(time.RFC3339)
-	cmap, err = locker.Clientset.CoreV1().ConfigMaps(locker.Namespace).Update(l.Context, cmap, metav1.UpdateOptions{})
-	if err != nil {
-		return nil, fmt.Errorf("Error setting reservation for %s: %w", name, err)
-	}
-	return cmap, nil
-}
 
-func (locker *KubeLocker) UpdateAndReleaseConfigMap(ctx context.Context, cmap *corev1.ConfigMap) error {
-	delete(cmap.ObjectMeta.Annotations, "reserved/by")
-	delete(cmap.ObjectMeta.Annotations, "reserved/expires")
-	_, err := locker.Clientset.CoreV1().ConfigMaps(locker.Namespace).Update(ctx, cmap, metav1.UpdateOptions{})
-	if err != nil {
-		return err
-	}
-	return nil
-}
+		lockStateJson, changed, err := applyChange(lockState, fn)
+		if lockStateJson == nil {
+			return err
+		}
+		fnErr = err
+		if cmap != nil && !changed {
+			return nil
+		}
 
-// TODO: look at potential corner-cases
-func (locker *KubeLocker) ReleaseConfigMap(l *Lock) error {
-	cmap, err := locker.GetConfigMap(l)
-	if err != nil {
+		if cmap == nil {
+			cmap = locker.newConfigMap(l)
+			cmap.Data["lock"] = string(lockStateJson)
+			_, err = locker.Clientset.CoreV1().ConfigMaps(locker.Namespace).Create(l.OperationContext(), cmap, metav1.CreateOptions{})
+			return err
+		}
+		if cmap.Data == nil {
+			cmap.Data = make(map[string]string)
+		}
+		cmap.Data["lock"] = string(lockStateJson)
+		_, err = locker.Clientset.CoreV1().ConfigMaps(locker.Namespace).Update(l.OperationContext(), cmap, metav1.UpdateOptions{})
 		return err
+	})
+	if err != nil {
+		return kubeConflict(l, err)
 	}
-	if cmap.ObjectMeta.Annotations["reserved/by"] == l.InstanceID {
-		delete(cmap.ObjectMeta.Annotations, "reserved/by")
-		delete(cmap.ObjectMeta.Annotations, "reserved/expires")
-		locker.Clientset.CoreV1().ConfigMaps(locker.Namespace).Update(l.Context, cmap, metav1.UpdateOptions{})
-	}
-	return nil
+	return fnErr
 }
 
 func (locker *KubeLocker) GetAllLocks() ([]*Lock, error) {
@@ -171,7 +213,7 @@ func (locker *KubeLocker) GetAllLocks() ([]*Lock, error) {
 	}
 	for _, item := range list.Items {
 		lockState := &Lock{}
-		if err := json.Unmarshal([]byte(item.Data["lock"]), lockState); err != nil {
+		if err := decodeLockState([]byte(item.Data["lock"]), lockState); err != nil {
 			return result, err
 		}
 		result = append(result, lockState)
@@ -179,123 +221,91 @@ func (locker *KubeLocker) GetAllLocks() ([]*Lock, error) {
 	return result, nil
 }
 
-func (locker *KubeLocker) Acquire(l *Lock) error {
-	err := locker.Init(l)
-	if err != nil {
-		return fmt.Errorf("Error initiating lock: %w", err)
+func (locker *KubeLocker) GetLock(name string) (*Lock, error) {
+	cmap, err := locker.GetConfigMap(&Lock{Name: name, Context: context.Background()})
+	if apierrors.IsNotFound(err) {
+		return nil, fmt.Errorf("Lock %s does not exist: %w", name, ErrLockNotFound)
 	}
-	cmap, err := locker.GetReservedConfigMap(l)
 	if err != nil {
-		return fmt.Errorf("GetReservedConfigMap: %w", err)
-	}
-
-	lockState := &Lock{}
-	if err := json.Unmarshal([]byte(cmap.Data["lock"]), lockState); err != nil {
-		locker.ReleaseConfigMap(l)
-		return err
-	}
-
-	force := false
-	if l.forceCondition != nil {
-		force, err = lockState.Evaluate(l.forceCondition)
-		if err != nil {
-			return err
-		}
-	}
-
-	if lockState.LockType == "" {
-		lockState.LockType = LockTypeMutex
-	}
-
-	leaseCount := len(lockState.Leases)
-	if lockState.LockType == LockTypeMutex && leaseCount > 0 {
-		if leaseCount > 1 {
-			locker.ReleaseConfigMap(l)
-			return fmt.Errorf("Invalid number of leases for mutex lock: %d", leaseCount)
-		}
-		for key, lease := range lockState.Leases {
-			if key != l.InstanceID && !lease.Expired() && !force {
-				locker.ReleaseConfigMap(l)
-				return fmt.Errorf("Mutex lock is already held by %s", lease.InstanceID)
-			}
-		}
+		return nil, err
 	}
-
-	if lockState.LockType == LockTypeMutex {
-		lockState.Leases = map[string]LockLease{
-			l.InstanceID: LockLease{InstanceID: l.InstanceID, Expires: l.NewExpiryTime()},
+	lockState := &Lock{Name: name}
+	if data, exists := cmap.Data["lock"]; exists {
+		if err := decodeLockState([]byte(data), lockState); err != nil {
+			return nil, err
 		}
-	} else {
-		locker.ReleaseConfigMap(l)
-		return fmt.Errorf("Non-mutex locks not implemented yet")
 	}
+	return lockState, nil
+}
 
-	syncLockFields(l, lockState)
+func (locker *KubeLocker) Acquire(l *Lock) error {
+	return locker.modify(l, true, func(lockState *Lock) error {
+		return lockState.grant(l)
+	})
+}
 
-	lockStateJson, err := json.Marshal(lockState)
-	if err != nil {
-		locker.ReleaseConfigMap(l)
-		return err
-	}
-	cmap.Data["lock"] = string(lockStateJson)
+func (locker *KubeLocker) Renew(l *Lock) error {
+	return locker.modify(l, false, func(lockState *Lock) error {
+		return lockState.renew(l)
+	})
+}
 
-	return locker.UpdateAndReleaseConfigMap(l.Context, cmap)
+func (locker *KubeLocker) Release(l *Lock) error {
+	return locker.modify(l, false, func(lockState *Lock) error {
+		lockState.release(l)
+		return nil
+	})
 }
 
-func (locker *KubeLocker) Renew(l *Lock) error {
-	cmap, err := locker.GetReservedConfigMap(l)
-	if err != nil {
-		return err
+// WaitForChange watches the lock ConfigMap and returns as soon as it changes or
+// a lease on the lock expires
+func (locker *KubeLocker) WaitForChange(ctx context.Context, l *Lock) error {
+	cmap, err := locker.GetConfigMap(l)
+	if apierrors.IsNotFound(err) {
+		return nil
 	}
-
-	lockState := &Lock{}
-	if err := json.Unmarshal([]byte(cmap.Data["lock"]), lockState); err != nil {
+	if err != nil {
 		return err
 	}
-
-	lease, exists := lockState.Leases[l.InstanceID]
-	if !exists {
-		return fmt.Errorf("No lease to renew for %s", l.InstanceID)
+	lockState := &Lock{Name: l.Name}
+	if data, exists := cmap.Data["lock"]; exists {
+		if err := decodeLockState([]byte(data), lockState); err != nil {
+			return err
+		}
 	}
-	if lease.Expired() {
-		return fmt.Errorf("Lease on lock %s for %s already expired", l.Name, l.InstanceID)
+	opts := metav1.ListOptions{
+		FieldSelector:   fields.OneTermEqualSelector("metadata.name", cmap.Name).String(),
+		ResourceVersion: cmap.ResourceVersion,
 	}
-	lease.Expires = l.NewExpiryTime()
-	lockState.Leases[l.InstanceID] = lease
-
-	lockStateJson, err := json.Marshal(lockState)
+	w, err := locker.Clientset.CoreV1().ConfigMaps(locker.Namespace).Watch(ctx, opts)
 	if err != nil {
 		return err
 	}
-	cmap.Data["lock"] = string(lockStateJson)
-
-	if err := locker.UpdateAndReleaseConfigMap(l.Context, cmap); err != nil {
-		return err
-	}
-	return nil
+	defer w.Stop()
+	return waitForWatchOrExpiry(ctx, w, lockState, l)
 }
 
-func (locker *KubeLocker) Release(l *Lock) error {
-	cmap, err := locker.GetReservedConfigMap(l)
-	if err != nil {
+// waitForWatchOrExpiry returns immediately if the lock state would allow l to acquire it,
+// otherwise it blocks until an event is received on w or the next lease on the lock expires
+func waitForWatchOrExpiry(ctx context.Context, w watch.Interface, lockState *Lock, l *Lock) error {
+	expiry, expiring := lockState.nextExpiry(l)
+	if err := lockState.admit(l); err == nil || !errors.Is(err, ErrLockHeld) {
 		return err
 	}
-
-	lockState := &Lock{}
-	if err := json.Unmarshal([]byte(cmap.Data["lock"]), lockState); err != nil {
-		return err
+	var expired <-chan time.Time
+	if expiring {
+		var stop func() bool
+		expired, stop = clockTimer(l.clock(), expiry.Sub(l.clock().Now()))
+		defer stop()
 	}
-
-	delete(lockState.Leases, l.InstanceID)
-	syncLockFields(l, lockState)
-
-	lockStateJson, err := json.Marshal(lockState)
-	if err != nil {
-		return err
+	select {
+	case <-w.ResultChan():
+		return nil
+	case <-expired:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	cmap.Data["lock"] = string(lockStateJson)
-
-	return locker.UpdateAndReleaseConfigMap(l.Context, cmap)
 }
 
 func GetKubeConfig() *rest.Config {
@@ -320,3 +330,7 @@ func GetKubeConfig() *rest.Config {
 	}
 	return config
 }
+
+func (locker *KubeLocker) clock() Clock {
+	return clockOrReal(locker.Clock)
+}
@@ -0,0 +1,392 @@
+package lockheed
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// isLeaseLost reports whether a renewal error means the lease can not be renewed anymore,
+// which includes the lock having been deleted along with the lease
+func isLeaseLost(err error) bool {
+	return errors.Is(err, ErrLeaseExpired) || errors.Is(err, ErrNotHolder) || errors.Is(err, ErrLockNotFound)
+}
+
+// applyChange runs fn on the lock state and returns the encoded state along with whether
+// fn changed it. Backends write the state whenever it changed, even if fn returned an
+// error, so that expired leases pruned on the way are dropped from storage. err is the
+// error of fn, or of encoding the state in which case nothing is to be written.
+func applyChange(lockState *Lock, fn func(lockState *Lock) error) (updated []byte, changed bool, err error) {
+	original, err := json.Marshal(lockState)
+	if err != nil {
+		return nil, false, err
+	}
+	fnErr := fn(lockState)
+	updated, err = json.Marshal(lockState)
+	if err != nil {
+		return nil, false, err
+	}
+	return updated, string(original) != string(updated), fnErr
+}
+
+// holderID identifies the holder of a lease, which is the lock instance unless an owner
+// identity shared by several lock instances was set
+func (l *Lock) holderID() string {
+	if l.Owner != "" {
+		return l.Owner
+	}
+	return l.InstanceID
+}
+
+// holds returns the number of times the holder acquired a reentrant lease
+func (lease *LockLease) holds() int {
+	if lease.Holds == 0 {
+		return 1
+	}
+	return lease.Holds
+}
+
+// leaseMode returns the mode in which l requests a lease on a lock of given type
+func (l *Lock) leaseMode(lockType LockType) LeaseMode {
+	switch lockType {
+	case LockTypeMutex:
+		return LeaseModeExclusive
+	case LockTypeSemaphore:
+		return LeaseModeShared
+	}
+	if l.Mode == "" {
+		return LeaseModeShared
+	}
+	return l.Mode
+}
+
+// weight returns the number of semaphore slots taken by the lease
+func (lease *LockLease) weight() int {
+	if lease.Weight == 0 {
+		return 1
+	}
+	return lease.Weight
+}
+
+func (l *Lock) newLease(mode LeaseMode) LockLease {
+	return LockLease{InstanceID: l.holderID(), Expires: l.NewExpiryTime(), Mode: mode}
+}
+
+// pruneExpired drops all leases that are no longer valid at given time from the lock state
+func (state *Lock) pruneExpired(now time.Time) {
+	for key, lease := range state.Leases {
+		if lease.ExpiredAt(now) {
+			delete(state.Leases, key)
+			if !lease.Pending && (state.Transitioned == nil || state.Transitioned.Before(lease.Expires)) {
+				state.transition(lease.Expires)
+			}
+		}
+	}
+}
+
+// transition records the time holders of the lock changed at
+func (state *Lock) transition(at time.Time) {
+	at = at.UTC()
+	state.Transitioned = &at
+}
+
+// grant evaluates the acquire request of l against the stored lock state and records
+// the lease of l in it if allowed. The state might be modified even if an error is
+// returned (ie. a pending exclusive request) and should be persisted if it changed.
+// On success l takes over the fencing token of its lease.
+func (state *Lock) grant(l *Lock) error {
+	err := state.admit(l)
+	l.setQueuePosition(state.queuePosition(l.holderID()))
+	if err != nil {
+		return err
+	}
+	l.setFencingToken(state.Leases[l.holderID()].Token)
+	return nil
+}
+
+// admit performs the state changes of grant without touching l
+func (state *Lock) admit(l *Lock) error {
+	var err error
+	now := l.clock().Now()
+	force := false
+	if l.forceCondition != nil {
+		force, err = state.evaluate(l.forceCondition, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	if state.LockType == "" {
+		state.LockType = l.LockType
+		if state.LockType == "" {
+			state.LockType = LockTypeMutex
+		}
+	}
+	if l.LockType != "" && l.LockType != state.LockType {
+		return fmt.Errorf("Lock %s is of type %s, not %s", state.Name, state.LockType, l.LockType)
+	}
+	if state.Leases == nil {
+		state.Leases = make(map[string]LockLease)
+	}
+	if state.LockType == LockTypeSemaphore {
+		if state.MaxLeases == nil {
+			if l.MaxLeases == nil {
+				return fmt.Errorf("Semaphore lock %s requires MaxLeases to be set", state.Name)
+			}
+			maxLeases := *l.MaxLeases
+			state.MaxLeases = &maxLeases
+		}
+		if l.MaxLeases != nil && *l.MaxLeases != *state.MaxLeases {
+			return fmt.Errorf("MaxLeases %d does not match %d stored for semaphore lock %s", *l.MaxLeases, *state.MaxLeases, state.Name)
+		}
+	}
+
+	previous, renewing := state.Leases[l.holderID()]
+	renewing = renewing && !previous.Pending && !previous.ExpiredAt(now) && previous.Token != 0
+
+	// waiters queued ahead have precedence over anyone not already holding the lock
+	state.pruneQueue(now)
+	if position := state.queuePosition(l.holderID()); !force && !renewing && position != 1 && len(state.Queue) > 0 {
+		ahead := len(state.Queue)
+		if position > 0 {
+			ahead = position - 1
+		}
+		first := state.Queue[0]
+		state.enqueue(l)
+		return state.heldError(l, first.InstanceID, first.Expires, fmt.Sprintf("Lock %s has %d waiter(s) queued ahead", state.Name, ahead))
+	}
+
+	switch state.LockType {
+	case LockTypeMutex:
+		err = state.grantMutex(l, force, now)
+	case LockTypeShared:
+		err = state.grantShared(l, force, now)
+	case LockTypeSemaphore:
+		err = state.grantSemaphore(l, force, now)
+	default:
+		err = fmt.Errorf("Unsupported lock type %s: %w", state.LockType, ErrCorruptState)
+	}
+	if err != nil {
+		state.enqueue(l)
+		return err
+	}
+	state.dequeue(l.holderID())
+
+	// a holder acquiring again keeps its token, every new acquisition gets the next one
+	lease := state.Leases[l.holderID()]
+	if renewing {
+		lease.Token = previous.Token
+	} else {
+		state.Fence++
+		lease.Token = state.Fence
+		state.transition(now)
+	}
+	if l.Reentrant {
+		lease.Holds = 1
+		if renewing {
+			lease.Holds = previous.holds() + 1
+		}
+	}
+	state.Leases[l.holderID()] = lease
+
+	syncLockFields(l, state)
+	return nil
+}
+
+func (state *Lock) grantMutex(l *Lock, force bool, now time.Time) error {
+	leaseCount := len(state.Leases)
+	if leaseCount > 1 {
+		return fmt.Errorf("Invalid number of leases for mutex lock: %d: %w", leaseCount, ErrCorruptState)
+	}
+	for key, lease := range state.Leases {
+		if key != l.holderID() && !lease.ExpiredAt(now) && !force {
+			return state.heldError(l, lease.InstanceID, lease.Expires, fmt.Sprintf("Mutex lock is already held by %s", lease.InstanceID))
+		}
+	}
+	state.Leases = map[string]LockLease{
+		l.holderID(): l.newLease(LeaseModeExclusive),
+	}
+	return nil
+}
+
+// grantShared implements a writer preferring readers-writer lock. An exclusive request
+// which has to wait for readers leaves a pending lease behind, that blocks new readers
+// until it is either granted, withdrawn or expires.
+func (state *Lock) grantShared(l *Lock, force bool, now time.Time) error {
+	mode := l.leaseMode(state.LockType)
+	state.pruneExpired(now)
+
+	readers := 0
+	for key, lease := range state.Leases {
+		if key == l.holderID() {
+			continue
+		}
+		var conflict error
+		switch {
+		case lease.Pending && mode == LeaseModeShared:
+			conflict = state.heldError(l, lease.InstanceID, lease.Expires, fmt.Sprintf("Shared lock has a pending exclusive request by %s", lease.InstanceID))
+		case lease.Pending:
+			// other waiting writers do not prevent acquisition, first one to get in wins
+		case lease.Mode == LeaseModeExclusive:
+			conflict = state.heldError(l, lease.InstanceID, lease.Expires, fmt.Sprintf("Shared lock is exclusively held by %s", lease.InstanceID))
+		case mode == LeaseModeExclusive:
+			readers++
+		}
+		if force && (conflict != nil || (mode == LeaseModeExclusive && !lease.Pending)) {
+			delete(state.Leases, key)
+			continue
+		}
+		if conflict != nil {
+			return conflict
+		}
+	}
+
+	own, held := state.Leases[l.holderID()]
+	if mode == LeaseModeExclusive && readers > 0 && !force {
+		if !held || own.Pending {
+			pending := l.newLease(LeaseModeExclusive)
+			pending.Pending = true
+			state.Leases[l.holderID()] = pending
+		}
+		return state.heldError(l, "", time.Time{}, fmt.Sprintf("Shared lock is held by %d other shared lease(s)", readers))
+	}
+
+	state.Leases[l.holderID()] = l.newLease(mode)
+	return nil
+}
+
+// grantSemaphore allows leases until the sum of their weights reaches MaxLeases,
+// a forced acquisition evicts all other leases
+func (state *Lock) grantSemaphore(l *Lock, force bool, now time.Time) error {
+	state.pruneExpired(now)
+	lease := l.newLease(LeaseModeShared)
+	lease.Weight = l.Weight
+	if lease.Weight < 0 {
+		return fmt.Errorf("Invalid lease weight %d", lease.Weight)
+	}
+	if lease.weight() > *state.MaxLeases {
+		return fmt.Errorf("Lease weight %d exceeds MaxLeases %d of semaphore lock %s", lease.weight(), *state.MaxLeases, state.Name)
+	}
+
+	used := 0
+	for key, other := range state.Leases {
+		if key != l.holderID() {
+			used += other.weight()
+		}
+	}
+	if used+lease.weight() > *state.MaxLeases {
+		if !force {
+			return state.heldError(l, "", time.Time{}, fmt.Sprintf("Semaphore lock %s has %d of %d slots taken", state.Name, used, *state.MaxLeases))
+		}
+		state.Leases = make(map[string]LockLease)
+	}
+
+	state.Leases[l.holderID()] = lease
+	return nil
+}
+
+// renew extends the lease of l within the stored lock state
+func (state *Lock) renew(l *Lock) error {
+	lease, exists := state.Leases[l.holderID()]
+	if !exists || lease.Pending {
+		return fmt.Errorf("No lease to renew for %s: %w", l.holderID(), ErrNotHolder)
+	}
+	now := l.clock().Now()
+	if lease.ExpiredAt(now) {
+		return fmt.Errorf("Lease on lock %s for %s already expired: %w", l.Name, l.holderID(), ErrLeaseExpired)
+	}
+	state.pruneExpired(now)
+	lease.Expires = l.NewExpiryTime()
+	state.Leases[l.holderID()] = lease
+	return nil
+}
+
+// release drops the lease (or pending request) and queue ticket of l from the stored lock state,
+// a reentrant lease is dropped only once it was released as many times as it was acquired
+func (state *Lock) release(l *Lock) {
+	now := l.clock().Now()
+	if lease, exists := state.Leases[l.holderID()]; exists && lease.holds() > 1 {
+		lease.Holds--
+		state.Leases[l.holderID()] = lease
+	} else if exists && !lease.Pending {
+		delete(state.Leases, l.holderID())
+		state.transition(now)
+	} else {
+		delete(state.Leases, l.holderID())
+	}
+	state.dequeue(l.holderID())
+	state.pruneQueue(now)
+	state.pruneExpired(now)
+	syncLockFields(l, state)
+}
+
+// nextExpiry returns the earliest expiry of any lease on the lock other than the one of l
+func (state *Lock) nextExpiry(l *Lock) (time.Time, bool) {
+	var next time.Time
+	found := false
+	now := l.clock().Now()
+	for key, lease := range state.Leases {
+		if key == l.holderID() || lease.ExpiredAt(now) {
+			continue
+		}
+		if !found || lease.Expires.Before(next) {
+			next = lease.Expires
+			found = true
+		}
+	}
+	for _, ticket := range state.Queue {
+		if ticket.InstanceID == l.holderID() {
+			continue
+		}
+		if !found || ticket.Expires.Before(next) {
+			next = ticket.Expires
+			found = true
+		}
+	}
+	return next, found
+}
+
+// queuePosition returns the 1-based position of the ticket of instanceID in the queue, or 0
+func (state *Lock) queuePosition(instanceID string) int {
+	for i, ticket := range state.Queue {
+		if ticket.InstanceID == instanceID {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// enqueue adds a ticket for l to the end of the queue or refreshes the existing one,
+// unless l does not wait in the queue
+func (state *Lock) enqueue(l *Lock) {
+	if l.QueueTTL == 0 {
+		return
+	}
+	expires := l.clock().Now().Add(l.QueueTTL)
+	if position := state.queuePosition(l.holderID()); position > 0 {
+		state.Queue[position-1].Expires = expires
+		return
+	}
+	state.Queue = append(state.Queue, QueueTicket{InstanceID: l.holderID(), Expires: expires})
+}
+
+func (state *Lock) dequeue(instanceID string) {
+	if position := state.queuePosition(instanceID); position > 0 {
+		state.Queue = append(state.Queue[:position-1], state.Queue[position:]...)
+	}
+	if len(state.Queue) == 0 {
+		state.Queue = nil
+	}
+}
+
+// pruneQueue drops abandoned tickets which were not refreshed in time
+func (state *Lock) pruneQueue(now time.Time) {
+	var queue []QueueTicket
+	for _, ticket := range state.Queue {
+		if now.Before(ticket.Expires) {
+			queue = append(queue, ticket)
+		}
+	}
+	state.Queue = queue
+}
@@ -0,0 +1,293 @@
+package lockheed
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSharedLockGrant(t *testing.T) {
+	state := &Lock{Name: "shared"}
+	readerA := NewLock("shared", nil).WithDuration(10 * time.Second).WithLockType(LockTypeShared)
+	readerB := NewLock("shared", nil).WithDuration(10 * time.Second).WithLockType(LockTypeShared)
+	writer := NewLock("shared", nil).WithDuration(10 * time.Second).WithLockType(LockTypeShared).WithMode(LeaseModeExclusive)
+	readerC := NewLock("shared", nil).WithDuration(10 * time.Second).WithLockType(LockTypeShared)
+
+	if err := state.grant(readerA); err != nil {
+		t.Error(err)
+	}
+	if err := state.grant(readerB); err != nil {
+		t.Error(err)
+	}
+	if err := state.grant(writer); err == nil {
+		t.Error("Expected writer to wait for readers")
+	}
+	if lease := state.Leases[writer.InstanceID]; !lease.Pending {
+		t.Error("Expected pending exclusive lease")
+	}
+	if err := state.grant(readerC); err == nil {
+		t.Error("Expected new reader to be blocked by pending writer")
+	}
+	if err := state.renew(readerA); err != nil {
+		t.Error(err)
+	}
+	if err := state.renew(writer); err == nil {
+		t.Error("Expected pending lease not to be renewable")
+	}
+
+	state.release(readerA)
+	state.release(readerB)
+	if err := state.grant(writer); err != nil {
+		t.Error(err)
+	}
+	if lease := state.Leases[writer.InstanceID]; lease.Pending || lease.Mode != LeaseModeExclusive {
+		t.Error("Expected active exclusive lease")
+	}
+	if err := state.grant(readerC); err == nil {
+		t.Error("Expected reader to be blocked by writer")
+	}
+	state.release(writer)
+	if err := state.grant(readerC); err != nil {
+		t.Error(err)
+	}
+	if len(state.Leases) != 1 {
+		t.Errorf("Expected 1 lease, got %d", len(state.Leases))
+	}
+}
+
+func TestLockTypeMismatch(t *testing.T) {
+	state := &Lock{Name: "typed"}
+	if err := state.grant(NewLock("typed", nil)); err != nil {
+		t.Error(err)
+	}
+	if err := state.grant(NewLock("typed", nil).WithLockType(LockTypeShared)); err == nil {
+		t.Error("Expected lock type mismatch")
+	}
+}
+
+func TestSemaphoreLockGrant(t *testing.T) {
+	state := &Lock{Name: "semaphore"}
+	newHolder := func() *Lock {
+		return NewLock("semaphore", nil).WithDuration(10 * time.Second).WithLockType(LockTypeSemaphore).WithMaxLeases(3)
+	}
+	holderA := newHolder()
+	heavy := newHolder().WithWeight(2)
+	holderB := newHolder()
+
+	if err := state.grant(holderA); err != nil {
+		t.Error(err)
+	}
+	if err := state.grant(heavy); err != nil {
+		t.Error(err)
+	}
+	if err := state.grant(holderB); err == nil {
+		t.Error("Expected semaphore to be full")
+	}
+	if err := state.grant(newHolder().WithWeight(4)); err == nil {
+		t.Error("Expected weight exceeding MaxLeases to fail")
+	}
+	if err := state.grant(NewLock("semaphore", nil).WithLockType(LockTypeSemaphore).WithMaxLeases(5)); err == nil {
+		t.Error("Expected MaxLeases mismatch")
+	}
+	state.release(heavy)
+	if err := state.grant(holderB); err != nil {
+		t.Error(err)
+	}
+	if *state.MaxLeases != 3 {
+		t.Errorf("Expected MaxLeases 3, got %d", *state.MaxLeases)
+	}
+}
+
+func TestLockHeldError(t *testing.T) {
+	state := &Lock{Name: "held", Options: Options{Tags: []string{"deploy"}}}
+	holder := NewLock("held", nil).WithDuration(10 * time.Second)
+	other := NewLock("held", nil).WithDuration(10 * time.Second)
+	if err := state.grant(holder); err != nil {
+		t.Error(err)
+	}
+	err := state.grant(other)
+	if !errors.Is(err, ErrLockHeld) {
+		t.Errorf("Expected ErrLockHeld, got %v", err)
+	}
+	var held *LockHeldError
+	if !errors.As(err, &held) {
+		t.Fatal("Expected LockHeldError")
+	}
+	if held.InstanceID != holder.InstanceID || !held.Expires.Equal(state.Leases[holder.InstanceID].Expires) {
+		t.Errorf("Expected holder %s, got %s", holder.InstanceID, held.InstanceID)
+	}
+	if len(held.Tags) != 1 || held.Tags[0] != "deploy" || len(held.Holders) != 1 {
+		t.Errorf("Unexpected error details %+v", held)
+	}
+
+	if err := state.renew(other); !errors.Is(err, ErrNotHolder) {
+		t.Errorf("Expected ErrNotHolder, got %v", err)
+	}
+	lease := state.Leases[holder.InstanceID]
+	lease.Expires = time.Now().Add(-time.Second)
+	state.Leases[holder.InstanceID] = lease
+	if err := state.renew(holder); !errors.Is(err, ErrLeaseExpired) {
+		t.Errorf("Expected ErrLeaseExpired, got %v", err)
+	}
+
+	state.Leases["extra"] = LockLease{InstanceID: "extra", Expires: time.Now().Add(time.Second)}
+	state.Leases["another"] = LockLease{InstanceID: "another", Expires: time.Now().Add(time.Second)}
+	if err := state.grant(other); !errors.Is(err, ErrCorruptState) {
+		t.Errorf("Expected ErrCorruptState, got %v", err)
+	}
+}
+
+func TestApplyChange(t *testing.T) {
+	state := &Lock{Name: "change"}
+	holder := NewLock("change", nil).WithDuration(10 * time.Second)
+	other := NewLock("change", nil).WithDuration(10 * time.Second)
+	if updated, changed, err := applyChange(state, func(lockState *Lock) error {
+		return lockState.grant(holder)
+	}); err != nil || !changed || updated == nil {
+		t.Errorf("Expected granted lease to change the state, got %v", err)
+	}
+	if _, changed, err := applyChange(state, func(lockState *Lock) error {
+		return lockState.grant(other)
+	}); !errors.Is(err, ErrLockHeld) || changed {
+		t.Errorf("Expected refused grant to leave the state unchanged, got %v", err)
+	}
+
+	// expired leases pruned by a refused grant still count as change
+	lease := state.Leases[holder.InstanceID]
+	lease.Expires = time.Now().Add(-time.Second)
+	state.Leases[holder.InstanceID] = lease
+	if _, changed, err := applyChange(state, func(lockState *Lock) error {
+		lockState.pruneExpired(time.Now())
+		return ErrLockHeld
+	}); !errors.Is(err, ErrLockHeld) || !changed {
+		t.Errorf("Expected pruned state to be reported as changed along with the error, got %v", err)
+	}
+}
+
+func TestNextExpiry(t *testing.T) {
+	state := &Lock{Name: "expiring"}
+	holderA := NewLock("expiring", nil).WithDuration(10 * time.Second).WithLockType(LockTypeShared)
+	holderB := NewLock("expiring", nil).WithDuration(20 * time.Second).WithLockType(LockTypeShared)
+	if _, found := state.nextExpiry(holderA); found {
+		t.Error("Expected no expiry on empty lock")
+	}
+	state.grant(holderA)
+	state.grant(holderB)
+	expiry, found := state.nextExpiry(holderB)
+	if !found || !expiry.Equal(state.Leases[holderA.InstanceID].Expires) {
+		t.Error("Expected expiry of holderA lease")
+	}
+}
+
+func TestFencingTokens(t *testing.T) {
+	state := &Lock{Name: "fenced"}
+	holderA := NewLock("fenced", nil).WithDuration(10 * time.Second)
+	holderB := NewLock("fenced", nil).WithDuration(10 * time.Second).WithForce(Condition{
+		Operation: OperationEquals,
+		Field:     FieldAcquired,
+		Value:     true,
+	})
+
+	if err := state.grant(holderA); err != nil {
+		t.Error(err)
+	}
+	if holderA.FencingToken() != 1 {
+		t.Errorf("Expected token 1, got %d", holderA.FencingToken())
+	}
+	if err := state.grant(holderA); err != nil {
+		t.Error(err)
+	}
+	if holderA.FencingToken() != 1 {
+		t.Error("Expected token to be kept by acquiring holder")
+	}
+	if err := state.grant(holderB); err != nil {
+		t.Error(err)
+	}
+	if holderB.FencingToken() != 2 || state.Fence != 2 {
+		t.Errorf("Expected takeover token 2, got %d", holderB.FencingToken())
+	}
+	state.release(holderB)
+	if err := state.grant(holderA); err != nil {
+		t.Error(err)
+	}
+	if holderA.FencingToken() != 3 {
+		t.Errorf("Expected token 3, got %d", holderA.FencingToken())
+	}
+}
+
+func TestQueueOrder(t *testing.T) {
+	state := &Lock{Name: "queued"}
+	holder := NewLock("queued", nil).WithDuration(10 * time.Second)
+	first := NewLock("queued", nil).WithDuration(10 * time.Second).WithQueue(time.Minute)
+	second := NewLock("queued", nil).WithDuration(10 * time.Second).WithQueue(time.Minute)
+	abandoned := NewLock("queued", nil).WithDuration(10 * time.Second).WithQueue(time.Millisecond)
+
+	if err := state.grant(holder); err != nil {
+		t.Error(err)
+	}
+	if err := state.grant(abandoned); err == nil {
+		t.Error("Expected lock to be held")
+	}
+	if err := state.grant(first); err == nil {
+		t.Error("Expected lock to be held")
+	}
+	if err := state.grant(second); err == nil {
+		t.Error("Expected lock to be held")
+	}
+	if len(state.Queue) != 3 || second.waiterPosition != 3 {
+		t.Errorf("Expected 3 tickets in queue, got %d", len(state.Queue))
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	state.release(holder)
+	if len(state.Queue) != 2 {
+		t.Error("Expected abandoned ticket to be pruned")
+	}
+	if err := state.grant(second); err == nil {
+		t.Error("Expected second waiter to wait for the first one")
+	}
+	if err := state.grant(NewLock("queued", nil)); err == nil {
+		t.Error("Expected waiter outside of queue not to jump it")
+	}
+	if err := state.grant(first); err != nil {
+		t.Error(err)
+	}
+	if state.queuePosition(first.InstanceID) != 0 || state.queuePosition(second.InstanceID) != 1 {
+		t.Error("Expected first waiter to leave the queue")
+	}
+	state.release(first)
+	if err := state.grant(second); err != nil {
+		t.Error(err)
+	}
+	if state.Queue != nil {
+		t.Error("Expected empty queue")
+	}
+}
+
+func TestReentrantLease(t *testing.T) {
+	state := &Lock{Name: "reentrant"}
+	outer := NewLock("reentrant", nil).WithDuration(10 * time.Second).WithOwner("worker-1").WithReentrant()
+	inner := NewLock("reentrant", nil).WithDuration(10 * time.Second).WithOwner("worker-1").WithReentrant()
+	other := NewLock("reentrant", nil).WithDuration(10 * time.Second)
+
+	if err := state.grant(outer); err != nil {
+		t.Error(err)
+	}
+	if err := state.grant(inner); err != nil {
+		t.Error(err)
+	}
+	if holds := state.Leases["worker-1"].Holds; holds != 2 {
+		t.Errorf("Expected 2 holds, got %d", holds)
+	}
+	if inner.FencingToken() != outer.FencingToken() {
+		t.Error("Expected reentrant acquisition to keep the fencing token")
+	}
+	state.release(inner)
+	if err := state.grant(other); err == nil {
+		t.Error("Expected lock to be still held by outer")
+	}
+	state.release(outer)
+	if err := state.grant(other); err != nil {
+		t.Error(err)
+	}
+}
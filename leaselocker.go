@@ -0,0 +1,296 @@
+package lockheed
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/kubernetes"
+	kretry "k8s.io/client-go/util/retry"
+)
+
+const (
+	leaseTypeAnnotation  = "lockheed/type"
+	leaseTagsAnnotation  = "lockheed/tags"
+	leaseStateAnnotation = "lockheed/state"
+)
+
+// LeaseLocker stores lock state in coordination.k8s.io/v1 Lease objects. Holders are
+// reflected in the Lease spec while lockheed specific data lives in annotations.
+type LeaseLocker struct {
+	Clientset kubernetes.Interface
+	Namespace string
+	Prefix    string
+	Clock     Clock
+}
+
+func NewLeaseLocker(cset kubernetes.Interface, namespace string) *LeaseLocker {
+	locker := &LeaseLocker{
+		Clientset: cset,
+		Namespace: namespace,
+		Prefix:    "lockheed",
+	}
+	return locker
+}
+
+func (locker *LeaseLocker) GetLeaseName(l *Lock) string {
+	return locker.Prefix + "-" + l.Name
+}
+
+func (locker *LeaseLocker) GetLease(l *Lock) (*coordinationv1.Lease, error) {
+	name := locker.GetLeaseName(l)
+	lease, err := locker.Clientset.CoordinationV1().Leases(locker.Namespace).Get(l.OperationContext(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return lease, nil
+}
+
+func (locker *LeaseLocker) newLease(l *Lock) *coordinationv1.Lease {
+	transitions := int32(0)
+	return &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: locker.GetLeaseName(l),
+			Labels: map[string]string{
+				"lockheed/lock": "",
+			},
+		},
+		Spec: coordinationv1.LeaseSpec{
+			LeaseTransitions: &transitions,
+		},
+	}
+}
+
+// decodeLease reads the lock state out of the annotations of a Lease
+func decodeLease(lease *coordinationv1.Lease) (*Lock, error) {
+	lockState := &Lock{}
+	if data, exists := lease.Annotations[leaseStateAnnotation]; exists {
+		if err := decodeLockState([]byte(data), lockState); err != nil {
+			return nil, err
+		}
+	}
+	lockState.LockType = LockType(lease.Annotations[leaseTypeAnnotation])
+	lockState.Tags = nil
+	if tags := lease.Annotations[leaseTagsAnnotation]; tags != "" {
+		if err := json.Unmarshal([]byte(tags), &lockState.Tags); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCorruptState, err)
+		}
+	}
+	return lockState, nil
+}
+
+// encodeLease writes the lock state into the annotations of a Lease and reflects
+// the current holders in its spec
+func encodeLease(lease *coordinationv1.Lease, lockState *Lock, l *Lock) error {
+	// type and tags are kept in their own annotations
+	lockType, tags := lockState.LockType, lockState.Tags
+	lockState.LockType, lockState.Tags = "", nil
+	data, err := json.Marshal(lockState)
+	lockState.LockType, lockState.Tags = lockType, tags
+	if err != nil {
+		return err
+	}
+	if lease.Annotations == nil {
+		lease.Annotations = make(map[string]string)
+	}
+	lease.Annotations[leaseStateAnnotation] = string(data)
+	lease.Annotations[leaseTypeAnnotation] = string(lockState.LockType)
+	delete(lease.Annotations, leaseTagsAnnotation)
+	if len(lockState.Tags) > 0 {
+		// a JSON list, as tags may contain any character
+		tags, err := json.Marshal(lockState.Tags)
+		if err != nil {
+			return err
+		}
+		lease.Annotations[leaseTagsAnnotation] = string(tags)
+	}
+
+	current := l.clock().Now()
+	var holders []string
+	for key, lockLease := range lockState.Leases {
+		if !lockLease.ExpiredAt(current) && !lockLease.Pending {
+			holders = append(holders, key)
+		}
+	}
+	sort.Strings(holders)
+	holder := strings.Join(holders, ",")
+	previous := ""
+	if lease.Spec.HolderIdentity != nil {
+		previous = *lease.Spec.HolderIdentity
+	}
+
+	now := metav1.NewMicroTime(current)
+	if holder == "" {
+		lease.Spec.HolderIdentity = nil
+		lease.Spec.AcquireTime = nil
+		lease.Spec.RenewTime = nil
+		return nil
+	}
+	if holder != previous {
+		lease.Spec.AcquireTime = &now
+		if previous != "" {
+			transitions := int32(1)
+			if lease.Spec.LeaseTransitions != nil {
+				transitions = *lease.Spec.LeaseTransitions + 1
+			}
+			lease.Spec.LeaseTransitions = &transitions
+		}
+	}
+	lease.Spec.HolderIdentity = &holder
+	lease.Spec.RenewTime = &now
+	lease.Spec.LeaseDurationSeconds = nil
+	if l.Duration != 0 {
+		seconds := int32(math.Ceil(l.Duration.Seconds()))
+		lease.Spec.LeaseDurationSeconds = &seconds
+	}
+	return nil
+}
+
+// modify runs a single read-modify-write cycle of the lock state stored in the Lease,
+// relying on its resourceVersion and retrying on conflicts. A missing Lease is created
+// only if create is set.
+func (locker *LeaseLocker) modify(l *Lock, create bool, fn func(lockState *Lock) error) error {
+	var fnErr error
+	retriable := func(err error) bool {
+		return apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err)
+	}
+	err := kretry.OnError(kretry.DefaultBackoff, retriable, func() error {
+		fnErr = nil
+		lease, err := locker.GetLease(l)
+		if apierrors.IsNotFound(err) && create {
+			lease, err = nil, nil
+		}
+		if apierrors.IsNotFound(err) {
+			return fmt.Errorf("Lock %s does not exist: %w", l.Name, ErrLockNotFound)
+		}
+		if err != nil {
+			return err
+		}
+
+		lockState := &Lock{Name: l.Name}
+		if lease != nil {
+			lockState, err = decodeLease(lease)
+			if err != nil {
+				return err
+			}
+		}
+
+		updated, changed, err := applyChange(lockState, fn)
+		if updated == nil {
+			return err
+		}
+		fnErr = err
+		if lease != nil && !changed {
+			return nil
+		}
+
+		if lease == nil {
+			lease = locker.newLease(l)
+			if err := encodeLease(lease, lockState, l); err != nil {
+				return err
+			}
+			_, err = locker.Clientset.CoordinationV1().Leases(locker.Namespace).Create(l.OperationContext(), lease, metav1.CreateOptions{})
+			return err
+		}
+		if err := encodeLease(lease, lockState, l); err != nil {
+			return err
+		}
+		_, err = locker.Clientset.CoordinationV1().Leases(locker.Namespace).Update(l.OperationContext(), lease, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return kubeConflict(l, err)
+	}
+	return fnErr
+}
+
+func (locker *LeaseLocker) GetAllLocks() ([]*Lock, error) {
+	var result []*Lock
+	opts := metav1.ListOptions{
+		LabelSelector: "lockheed/lock",
+	}
+	list, err := locker.Clientset.CoordinationV1().Leases(locker.Namespace).List(context.Background(), opts)
+	if err != nil {
+		return result, err
+	}
+	for i := range list.Items {
+		lockState, err := decodeLease(&list.Items[i])
+		if err != nil {
+			return result, err
+		}
+		result = append(result, lockState)
+	}
+	return result, nil
+}
+
+func (locker *LeaseLocker) GetLock(name string) (*Lock, error) {
+	lease, err := locker.GetLease(&Lock{Name: name, Context: context.Background()})
+	if apierrors.IsNotFound(err) {
+		return nil, fmt.Errorf("Lock %s does not exist: %w", name, ErrLockNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	lockState, err := decodeLease(lease)
+	if err != nil {
+		return nil, err
+	}
+	lockState.Name = name
+	return lockState, nil
+}
+
+func (locker *LeaseLocker) Acquire(l *Lock) error {
+	return locker.modify(l, true, func(lockState *Lock) error {
+		return lockState.grant(l)
+	})
+}
+
+func (locker *LeaseLocker) Renew(l *Lock) error {
+	return locker.modify(l, false, func(lockState *Lock) error {
+		return lockState.renew(l)
+	})
+}
+
+func (locker *LeaseLocker) Release(l *Lock) error {
+	return locker.modify(l, false, func(lockState *Lock) error {
+		lockState.release(l)
+		return nil
+	})
+}
+
+// WaitForChange watches the lock Lease and returns as soon as it changes or
+// a lease on the lock expires
+func (locker *LeaseLocker) WaitForChange(ctx context.Context, l *Lock) error {
+	lease, err := locker.GetLease(l)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	lockState, err := decodeLease(lease)
+	if err != nil {
+		return err
+	}
+	opts := metav1.ListOptions{
+		FieldSelector:   fields.OneTermEqualSelector("metadata.name", lease.Name).String(),
+		ResourceVersion: lease.ResourceVersion,
+	}
+	w, err := locker.Clientset.CoordinationV1().Leases(locker.Namespace).Watch(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer w.Stop()
+	return waitForWatchOrExpiry(ctx, w, lockState, l)
+}
+
+func (locker *LeaseLocker) clock() Clock {
+	return clockOrReal(locker.Clock)
+}
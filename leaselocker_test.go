@@ -0,0 +1,143 @@
+package lockheed
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestLeaseEncoding(t *testing.T) {
+	locker := NewLeaseLocker(nil, "default")
+	holderA := NewLock("leased", locker).WithDuration(30 * time.Second).WithTags([]string{"a,b", "c"})
+	holderB := NewLock("leased", locker).WithDuration(30 * time.Second)
+
+	lease := locker.newLease(holderA)
+	lockState := &Lock{Name: "leased"}
+	if err := lockState.grant(holderA); err != nil {
+		t.Error(err)
+	}
+	if err := encodeLease(lease, lockState, holderA); err != nil {
+		t.Error(err)
+	}
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != holderA.InstanceID {
+		t.Error("Expected holder identity to be set")
+	}
+	if *lease.Spec.LeaseDurationSeconds != 30 || *lease.Spec.LeaseTransitions != 0 {
+		t.Error("Unexpected lease spec")
+	}
+
+	decoded, err := decodeLease(lease)
+	if err != nil {
+		t.Error(err)
+	}
+	if decoded.LockType != LockTypeMutex || len(decoded.Tags) != 2 || decoded.Tags[0] != "a,b" || decoded.Leases[holderA.InstanceID].InstanceID != holderA.InstanceID {
+		t.Error("Lock state not decoded as expected")
+	}
+	tags := lease.Annotations[leaseTagsAnnotation]
+	lease.Annotations[leaseTagsAnnotation] = "a,b"
+	if _, err := decodeLease(lease); !errors.Is(err, ErrCorruptState) {
+		t.Errorf("Expected ErrCorruptState for unreadable tags, got %v", err)
+	}
+	lease.Annotations[leaseTagsAnnotation] = tags
+
+	// partial seconds are rounded up rather than cutting the lease short
+	short := NewLock("leased", locker).WithDuration(1500 * time.Millisecond)
+	shortState := &Lock{Name: "leased"}
+	if err := shortState.grant(short); err != nil {
+		t.Error(err)
+	}
+	shortLease := locker.newLease(short)
+	if err := encodeLease(shortLease, shortState, short); err != nil {
+		t.Error(err)
+	}
+	if *shortLease.Spec.LeaseDurationSeconds != 2 {
+		t.Errorf("Expected lease duration rounded up to 2s, got %d", *shortLease.Spec.LeaseDurationSeconds)
+	}
+
+	decoded.release(holderA)
+	if err := decoded.grant(holderB); err != nil {
+		t.Error(err)
+	}
+	acquired := *lease.Spec.AcquireTime
+	if err := encodeLease(lease, decoded, holderB); err != nil {
+		t.Error(err)
+	}
+	if *lease.Spec.HolderIdentity != holderB.InstanceID || *lease.Spec.LeaseTransitions != 1 {
+		t.Error("Expected lease transition to holderB")
+	}
+	if lease.Spec.AcquireTime.Before(&acquired) {
+		t.Error("Expected acquire time to move forward")
+	}
+}
+
+func TestLeaseEncodingRelease(t *testing.T) {
+	lease := &coordinationv1.Lease{}
+	holder := NewLock("leased", nil)
+	lockState := &Lock{Name: "leased"}
+	lockState.grant(holder)
+	encodeLease(lease, lockState, holder)
+	lockState.release(holder)
+	encodeLease(lease, lockState, holder)
+	if lease.Spec.HolderIdentity != nil {
+		t.Error("Expected no holder after release")
+	}
+}
+
+func TestLeaseLocker(t *testing.T) {
+	locker := NewLeaseLocker(fake.NewSimpleClientset(), "default")
+	lockA := NewLock("leased", locker).WithDuration(10 * time.Second).WithTags([]string{"testtag"})
+	if err := lockA.Acquire(); err != nil {
+		t.Fatal(err)
+	}
+	lockB := NewLock("leased", locker).WithDuration(10 * time.Second)
+	if err := lockB.Acquire(); !errors.Is(err, ErrLockHeld) {
+		t.Errorf("Expected ErrLockHeld, got %v", err)
+	}
+	if err := lockA.Renew(); err != nil {
+		t.Error(err)
+	}
+
+	cond := &Condition{Operation: OperationEquals, Field: FieldAcquired, Value: true}
+	locks, err := GetLocks(locker, cond)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(locks) != 1 || locks[0].Name != "leased" || len(locks[0].Tags) != 1 {
+		t.Error("Lock not listed as expected")
+	}
+
+	if err := lockA.Release(); err != nil {
+		t.Error(err)
+	}
+	if err := lockB.Acquire(); err != nil {
+		t.Error(err)
+	}
+	if err := lockB.Release(); err != nil {
+		t.Error(err)
+	}
+	if err := NewLock("missing", locker).Release(); !errors.Is(err, ErrLockNotFound) {
+		t.Errorf("Expected ErrLockNotFound, got %v", err)
+	}
+}
+
+func TestLeaseLockerWatch(t *testing.T) {
+	locker := NewLeaseLocker(fake.NewSimpleClientset(), "default")
+	lockA := NewLock("watched", locker).WithDuration(time.Minute)
+	if err := lockA.Acquire(); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		lockA.Release()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	lockB := NewLock("watched", locker).WithDuration(time.Minute)
+	if err := lockB.AcquireContext(ctx, AcquireOptionWithWatch()); err != nil {
+		t.Error(err)
+	}
+}
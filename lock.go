@@ -2,9 +2,10 @@ package lockheed
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/goblain/go-retry"
-	"log"
 	"sync"
 	"time"
 
@@ -12,64 +13,98 @@ import (
 )
 
 const (
-	LockTypeMutex LockType = "mutex"
+	LockTypeMutex     LockType = "mutex"
+	LockTypeShared    LockType = "shared"
+	LockTypeSemaphore LockType = "semaphore"
 )
 
 type LockType string
 
+// abandonTimeout bounds the cleanup of a lease left behind by an interrupted acquire
+const abandonTimeout = 10 * time.Second
+
+const (
+	LeaseModeExclusive LeaseMode = "exclusive"
+	LeaseModeShared    LeaseMode = "shared"
+)
+
+type LeaseMode string
+
 type Lock struct {
-	Name       string               `json:"name"`
-	LockType   LockType             `json:"lockType"`
-	Leases     map[string]LockLease `json:"leases"`
-	InstanceID string               `json:"-"`
-	Context    context.Context      `json:"-"`
-	Cancel     func()               `json:"-"`
-	Locker     LockerInterface      `json:"-"`
+	Name     string               `json:"name"`
+	LockType LockType             `json:"lockType"`
+	Leases   map[string]LockLease `json:"leases"`
+	// Fence is the last fencing token issued for the lock
+	Fence uint64 `json:"fence,omitempty"`
+	// Queue holds tickets of waiters in order of arrival
+	Queue []QueueTicket `json:"queue,omitempty"`
+	// Transitioned is the last time a lease was granted or dropped
+	Transitioned *time.Time      `json:"transitioned,omitempty"`
+	InstanceID   string          `json:"-"`
+	Context      context.Context `json:"-"`
+	Cancel       func()          `json:"-"`
+	Locker       LockerInterface `json:"-"`
+	// Clock provides the time for lease timing, RealClock unless set
+	Clock Clock `json:"-"`
 	Options
-	stopChan     chan interface{}
-	eventChan    chan Event
-	eventHandler func(context.Context, chan Event)
-	initialized  bool
-	maintained   bool
-	mutex        sync.Mutex
+	stopChan       chan interface{}
+	events         *eventBus
+	handler        *Subscription
+	lifecycle      LockState
+	mutex          sync.Mutex
+	opContext      context.Context
+	started        time.Time
+	hold           *hold
+	holdMutex      sync.Mutex
+	fencingToken   uint64
+	waiterPosition int
 }
 
 type LockLease struct {
 	InstanceID string    `json:"instanceID"`
 	Expires    time.Time `json:"expires"`
+	Mode       LeaseMode `json:"mode,omitempty"`
+	Weight     int       `json:"weight,omitempty"`
+	Token      uint64    `json:"token,omitempty"`
+	// Holds counts acquisitions of a reentrant lease not released yet
+	Holds int `json:"holds,omitempty"`
+	// Pending marks an exclusive request waiting for shared leases to go away
+	Pending bool `json:"pending,omitempty"`
+}
+
+// QueueTicket reserves a place in the waiter queue of a lock, waiters need to keep
+// refreshing it by acquire attempts before it expires
+type QueueTicket struct {
+	InstanceID string    `json:"instanceID"`
+	Expires    time.Time `json:"expires"`
 }
 
+// Expired reports whether the lease is no longer valid according to RealClock, use
+// ExpiredAt with the time of the clock of the lock otherwise
 func (lease *LockLease) Expired() bool {
-	if time.Now().Before(lease.Expires) {
-		return false
-	}
-	return true
+	return lease.ExpiredAt(RealClock.Now())
+}
+
+// ExpiredAt reports whether the lease is no longer valid at given time
+func (lease *LockLease) ExpiredAt(now time.Time) bool {
+	return !now.Before(lease.Expires)
 }
 
 type Options struct {
 	Tags           []string      `json:"tags,omitempty"`
 	Duration       time.Duration `json:"-"`
 	RenewInterval  time.Duration `json:"-"`
-	MaxLeases      *int          `json:"-"`
+	MaxLeases      *int          `json:"maxLeases,omitempty"`
 	Takeover       *bool         `json:"-"`
+	Mode           LeaseMode     `json:"-"`
+	Weight         int           `json:"-"`
+	QueueTTL       time.Duration `json:"-"`
+	Owner          string        `json:"-"`
+	Reentrant      bool          `json:"-"`
 	resetTags      bool
 	forceCondition *Condition
 }
 
-func DefaultEventHandler(ctx context.Context, echan chan Event) {
-	for {
-		select {
-		case event := <-echan:
-			log.Printf("Event: %s\n", event.Message)
-			if event.Err != nil {
-				log.Printf("Error: %s\n", event.Err.Error())
-			}
-		case <-ctx.Done():
-			return
-		}
-	}
-}
-
 func NewLock(name string, locker LockerInterface) *Lock {
 	l := &Lock{Name: name}
 	l.Locker = locker
@@ -103,6 +138,65 @@ func (l *Lock) WithForce(c Condition) *Lock {
 	return l
 }
 
+// WithLockType sets the type of the lock, it has to match the type of an already existing lock
+func (l *Lock) WithLockType(lockType LockType) *Lock {
+	l.LockType = lockType
+	return l
+}
+
+// WithMode sets the mode of the lease requested on a shared lock
+func (l *Lock) WithMode(mode LeaseMode) *Lock {
+	l.Mode = mode
+	return l
+}
+
+// WithMaxLeases sets the number of slots of a semaphore lock, it has to match the stored value of an existing lock
+func (l *Lock) WithMaxLeases(maxLeases int) *Lock {
+	l.MaxLeases = &maxLeases
+	return l
+}
+
+// WithWeight sets the number of semaphore slots taken by the lease, 1 by default
+func (l *Lock) WithWeight(weight int) *Lock {
+	l.Weight = weight
+	return l
+}
+
+// WithQueue makes acquire attempts register a ticket in the FIFO waiter queue of the lock,
+// kept for ttl after each attempt. Only the first waiter in the queue can acquire the lock,
+// so ttl needs to be longer than the delay between attempts. The ticket is withdrawn once
+// the acquire fails.
+func (l *Lock) WithQueue(ttl time.Duration) *Lock {
+	l.QueueTTL = ttl
+	return l
+}
+
+// WithOwner sets the identity under which the lease is held, allowing several lock
+// instances to share a single lease. Defaults to the InstanceID of the lock.
+func (l *Lock) WithOwner(owner string) *Lock {
+	l.Owner = owner
+	return l
+}
+
+// WithReentrant makes the lease count acquisitions by its holder, so that it is
+// dropped only after being released as many times as it was acquired
+func (l *Lock) WithReentrant() *Lock {
+	l.Reentrant = true
+	return l
+}
+
+// WithClock sets the clock used for the lease timing of the lock, lockers take the time
+// from the clock of the lock they operate on
+func (l *Lock) WithClock(clock Clock) *Lock {
+	l.Clock = clock
+	return l
+}
+
+// clock returns the clock of the lock, RealClock if none was set
+func (l *Lock) clock() Clock {
+	return clockOrReal(l.Clock)
+}
+
 func (l *Lock) WithRenewInterval(interval time.Duration) *Lock {
 	l.RenewInterval = interval
 	return l
@@ -111,53 +205,133 @@ func (l *Lock) WithRenewInterval(interval time.Duration) *Lock {
 func (l *Lock) Init() {
 	l.InstanceID = uuid.New().String()
 	l.stopChan = make(chan interface{})
-	l.eventChan = make(chan Event)
-	l.eventHandler = DefaultEventHandler
-	go l.eventHandler(l.Context, l.eventChan)
-	l.initialized = true
+	l.events = &eventBus{}
+	l.WithEventHandler(DefaultEventHandler)
+	l.initHold()
+	l.lifecycle = LockStateIdle
 }
 
 type AcquireOptions struct {
 	RetryLogic *retry.RetryLogic
+	Backoff    *Backoff
+	Watch      bool
+}
+
+// Backoff describes the attempts of an acquisition: at most Attempts of them, the first
+// failed one followed by a wait of Delay, which is multiplied by Factor after every further
+// failed attempt, up to Max unless it is zero
+type Backoff struct {
+	Attempts int
+	Delay    time.Duration
+	Max      time.Duration
+	Factor   float64
 }
 
 type AcquireOption func(opts *AcquireOptions) error
 
+// AcquireOptionWithRetry runs the attempts of the acquisition according to rl. The waits of
+// a RetryLogic block the calling goroutine, so the context is only checked between attempts,
+// AcquireOptionWithBackoff waits in a way that is interrupted by the context.
 func AcquireOptionWithRetry(rl *retry.RetryLogic) AcquireOption {
 	return func(opts *AcquireOptions) error {
-		opts.RetryLogic = rl
+		opts.RetryLogic, opts.Backoff = rl, nil
 		return nil
 	}
 }
 
-func (l *Lock) Acquire(opts ...AcquireOption) error {
-	rl, err := retry.NewRetryLogic(retry.WithNoRetry())
-	if err != nil {
-		return err
+// AcquireOptionWithBackoff makes up to attempts acquisition attempts, waiting delay after the
+// first failed one and multiplying the wait by factor after every further one, up to max
+// unless it is zero. Waits follow the clock of the lock and end as soon as the context is done.
+func AcquireOptionWithBackoff(attempts int, delay, max time.Duration, factor float64) AcquireOption {
+	return func(opts *AcquireOptions) error {
+		if delay < 0 || max < 0 {
+			return fmt.Errorf("Negative backoff delay not supported")
+		}
+		if factor < 1 {
+			return fmt.Errorf("Backoff factor needs to be at least 1, got %v", factor)
+		}
+		opts.RetryLogic = nil
+		opts.Backoff = &Backoff{Attempts: attempts, Delay: delay, Max: max, Factor: factor}
+		return nil
 	}
-	ao := &AcquireOptions{RetryLogic: rl}
+}
+
+// AcquireOptionWithWatch makes Acquire block until the lock is acquired, retrying
+// whenever the locker reports a change of the lock state instead of polling.
+// The locker needs to implement WatcherInterface.
+func AcquireOptionWithWatch() AcquireOption {
+	return func(opts *AcquireOptions) error {
+		opts.Watch = true
+		return nil
+	}
+}
+
+func (l *Lock) Acquire(opts ...AcquireOption) error {
+	return l.AcquireContext(l.Context, opts...)
+}
+
+// AcquireContext acquires the lock, giving up as soon as ctx (or the lock context) is done.
+// When interrupted it makes sure that no lease written by an unfinished attempt is left
+// behind and returns an error wrapping the error of the context.
+func (l *Lock) AcquireContext(ctx context.Context, opts ...AcquireOption) error {
+	var err error
+	ao := &AcquireOptions{Backoff: &Backoff{Attempts: 1, Factor: 1}}
 	for _, opt := range opts {
 		if err := opt(ao); err != nil {
 			return err
 		}
 	}
-	if !l.initialized {
-		return fmt.Errorf("Lock needs to be properly initialized first")
+	if l.State() == "" {
+		return ErrNotInitialized
 	}
 	l.mutex.Lock()
 	defer l.mutex.Unlock()
+	if err := l.setState(LockStateAcquiring); err != nil {
+		return err
+	}
 
-	err = ao.RetryLogic.ExecuteFunc(func() error {
-		if err := l.Locker.Acquire(l); err != nil {
-			return err
+	opCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-l.Context.Done():
+			cancel()
+		case <-opCtx.Done():
 		}
-		return nil
-	})
+	}()
+	l.opContext = opCtx
+	if ao.Watch {
+		err = l.acquireWatching(opCtx)
+	} else if ao.RetryLogic != nil {
+		err = l.acquireRetryLogic(opCtx, ao.RetryLogic)
+	} else {
+		err = l.acquireBackoff(opCtx, ao.Backoff)
+	}
+	l.opContext = nil
+
 	if err != nil {
+		if opCtx.Err() != nil {
+			err = fmt.Errorf("Acquire of lock %s(%s) interrupted: %w", l.Name, l.InstanceID, ctx.Err())
+			if ctx.Err() == nil {
+				err = fmt.Errorf("Acquire of lock %s(%s) interrupted: %w", l.Name, l.InstanceID, l.Context.Err())
+			}
+		}
+		if !l.isHeld() && (opCtx.Err() != nil || l.QueueTTL > 0 || (l.LockType == LockTypeShared && l.Mode == LeaseModeExclusive)) {
+			// withdraw a lease, pending exclusive request or queue ticket possibly written by
+			// the failed attempt, so it does not block others after we gave up
+			l.abandon()
+		}
+		if l.isHeld() {
+			l.setState(LockStateHeld)
+		} else {
+			l.setState(LockStateIdle)
+		}
 		l.EmitAcquireFailed(err)
 		return err
 	}
 
+	l.startHold(l.started)
+	l.setState(LockStateHeld)
 	if l.RenewInterval.Seconds() != 0 {
 		go l.Maintain()
 	}
@@ -165,21 +339,150 @@ func (l *Lock) Acquire(opts ...AcquireOption) error {
 	return nil
 }
 
-func (l *Lock) AcquireRetry(retries int, delay time.Duration) error {
-	rl, err := retry.NewRetryLogic(retry.WithMaxAttempts(int32(retries)), retry.WithLinearBackoff(delay))
+// attempt makes a single acquisition attempt. An attempt finishing after ctx is done is
+// reported as interrupted, so that it gets rolled back.
+func (l *Lock) attempt(ctx context.Context) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	l.started = l.clock().Now()
+	err := l.Locker.Acquire(l)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
 	if err != nil {
-		return err
+		l.emitQueuePosition()
+	}
+	return err
+}
+
+// acquireBackoff runs the attempts according to the backoff, waiting between them on the
+// lock clock in a way that is interrupted by ctx
+func (l *Lock) acquireBackoff(ctx context.Context, backoff *Backoff) error {
+	delay := backoff.Delay
+	for attempt := 1; ; attempt++ {
+		err := l.attempt(ctx)
+		if err == nil || attempt >= backoff.Attempts {
+			return err
+		}
+		waited, stop := clockTimer(l.clock(), delay)
+		select {
+		case <-waited:
+		case <-ctx.Done():
+			stop()
+			return ctx.Err()
+		}
+		delay = time.Duration(float64(delay) * backoff.Factor)
+		if backoff.Max > 0 && delay > backoff.Max {
+			delay = backoff.Max
+		}
+	}
+}
+
+// acquireRetryLogic runs the attempts according to rl in the calling goroutine, ctx is
+// checked around every attempt but does not interrupt the waits of rl
+func (l *Lock) acquireRetryLogic(ctx context.Context, rl *retry.RetryLogic) error {
+	rl.Reset()
+	err := fmt.Errorf("No attempt to acquire lock %s allowed by the retry logic", l.Name)
+	for rl.Attempt() {
+		if err = l.attempt(ctx); err == nil || ctx.Err() != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func (l *Lock) acquireWatching(ctx context.Context) error {
+	watcher, ok := l.Locker.(WatcherInterface)
+	if !ok {
+		return fmt.Errorf("Locker %T does not support watching", l.Locker)
+	}
+	for {
+		l.started = l.clock().Now()
+		err := l.Locker.Acquire(l)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		// only contention goes away by waiting, anything else is reported right away
+		if !errors.Is(err, ErrLockHeld) {
+			return err
+		}
+		l.emitQueuePosition()
+		l.EmitDebug(fmt.Sprintf("waiting for lock state change: %s", err))
+		if err := l.waitForChange(ctx, watcher); err != nil {
+			return err
+		}
+	}
+}
+
+// waitForChange waits for the lock state to change, but no longer than half of the queue
+// ticket TTL so that the ticket gets refreshed by the following attempt
+func (l *Lock) waitForChange(ctx context.Context, watcher WatcherInterface) error {
+	if l.QueueTTL == 0 {
+		return watcher.WaitForChange(ctx, l)
+	}
+	waitCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := l.clock().AfterFunc(l.QueueTTL/2, cancel)
+	defer stop()
+	err := watcher.WaitForChange(waitCtx, l)
+	if err != nil && ctx.Err() == nil && waitCtx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+func (l *Lock) emitQueuePosition() {
+	l.holdMutex.Lock()
+	position := l.waiterPosition
+	l.holdMutex.Unlock()
+	if position > 0 {
+		l.EmitQueuePosition(position)
+	}
+}
+
+// abandon removes whatever an unsuccessful acquire might have left in the lock state,
+// using a fresh context as the one of the acquire is most likely done already
+func (l *Lock) abandon() {
+	ctx, cancel := context.WithTimeout(context.Background(), abandonTimeout)
+	defer cancel()
+	l.opContext = ctx
+	if err := l.Locker.Release(l); err != nil {
+		l.EmitDebug(fmt.Sprintf("cleanup after failed acquire: %s", err))
+	}
+	l.opContext = nil
+}
+
+// OperationContext returns the context lockers should use for API calls made
+// on behalf of the currently running operation on the lock
+func (l *Lock) OperationContext() context.Context {
+	if l.opContext != nil {
+		return l.opContext
 	}
-	return l.Acquire(AcquireOptionWithRetry(rl))
+	return l.Context
 }
 
+// AcquireRetry makes up to retries acquisition attempts, delay apart
+func (l *Lock) AcquireRetry(retries int, delay time.Duration) error {
+	return l.Acquire(AcquireOptionWithBackoff(retries, delay, 0, 1))
+}
+
+// Release drops the lease of the lock, a reentrant lease is dropped once released
+// as many times as it was acquired
 func (l *Lock) Release() error {
-	if !l.initialized {
-		return fmt.Errorf("Lock needs to be properly initialized first")
+	if l.State() == "" {
+		return ErrNotInitialized
 	}
 	l.mutex.Lock()
 	defer l.mutex.Unlock()
-	l.maintained = false
+	if l.endHold() && l.State() != LockStateReleased {
+		if err := l.setState(LockStateReleased); err != nil {
+			return err
+		}
+	}
 	if err := l.Locker.Release(l); err != nil {
 		l.EmitReleaseFailed(err)
 		return err
@@ -188,35 +491,46 @@ func (l *Lock) Release() error {
 	return nil
 }
 
+// Renew extends the lease of the held lock, it fails unless the lock is held
 func (l *Lock) Renew() error {
-	if !l.initialized {
-		return fmt.Errorf("Lock needs to be properly initialized first")
-	}
 	l.mutex.Lock()
 	defer l.mutex.Unlock()
+	if err := l.setState(LockStateRenewing); err != nil {
+		return err
+	}
+	started := l.clock().Now()
 	if err := l.Locker.Renew(l); err != nil {
 		l.EmitRenewFailed(err)
+		l.checkRenewFailure(err)
+		l.setStateIf(LockStateRenewing, LockStateHeld)
 		return err
 	}
+	l.extendHold(started)
+	l.setStateIf(LockStateRenewing, LockStateHeld)
 	l.EmitRenewSuccessful()
 	return nil
 }
 
+// Maintain renews the lease every RenewInterval until the current hold of the lock ends.
+// It returns right away if the lock is not held or the hold is maintained already.
 func (l *Lock) Maintain() {
-	l.maintained = true
+	held, claimed := l.claimMaintain()
+	if !claimed {
+		return
+	}
 	l.EmitMaintainStarted()
-	ticks := time.Tick(l.RenewInterval)
 	for {
+		tick, stop := clockTimer(l.clock(), l.RenewInterval)
 		select {
+		case <-held.Done():
+			stop()
+			l.EmitMaintainStopped()
+			return
 		case <-l.Context.Done():
-			l.maintained = false
+			stop()
 			l.EmitMaintainStopped()
 			return
-		case <-ticks:
-			if !l.maintained {
-				l.EmitMaintainStopped()
-				return
-			}
+		case <-tick:
 			l.Renew()
 		}
 	}
@@ -227,7 +541,15 @@ func (l *Lock) NewExpiryTime() time.Time {
 		loc, _ := time.LoadLocation("UTC")
 		return time.Date(9999, time.December, 31, 23, 59, 59, 0, loc)
 	}
-	return time.Now().Add(l.Duration)
+	return l.clock().Now().Add(l.Duration)
+}
+
+// decodeLockState reads the lock state stored by a locker into lockState
+func decodeLockState(data []byte, lockState *Lock) error {
+	if err := json.Unmarshal(data, lockState); err != nil {
+		return fmt.Errorf("%w: %v", ErrCorruptState, err)
+	}
+	return nil
 }
 
 func stringInSlice(pool []string, item string) bool {
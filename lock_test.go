@@ -2,19 +2,30 @@ package lockheed
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"testing"
 	"time"
 
+	"github.com/goblain/go-retry"
+
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	kretry "k8s.io/client-go/util/retry"
 )
 
-var cset *kubernetes.Clientset
+var cset kubernetes.Interface
 
 func GetTestKubeLocker() LockerInterface {
 	if cset == nil {
-		cset, _ = kubernetes.NewForConfig(GetKubeConfig())
+		cset = fake.NewSimpleClientset()
 	}
 	return NewKubeLocker(cset, "default")
 }
@@ -22,7 +33,7 @@ func GetTestKubeLocker() LockerInterface {
 func CreateEmptyConfigmap() error {
 	ctx := context.Background()
 	if cset == nil {
-		cset, _ = kubernetes.NewForConfig(GetKubeConfig())
+		cset = fake.NewSimpleClientset()
 	}
 	cmap := &corev1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
@@ -134,5 +145,406 @@ func TestKubeLocker(t *testing.T) {
 	if err := lockC.Release(); err != nil {
 		t.Error(err)
 	}
+	if err := NewLock("missing", GetTestKubeLocker()).Release(); !errors.Is(err, ErrLockNotFound) {
+		t.Errorf("Expected ErrLockNotFound, got %v", err)
+	}
 	time.Sleep(2 * time.Second)
 }
+
+// writeCompetingLease grants l a lease directly in the object tracker of client, as another
+// client would do. Reactors run while the fake clientset is locked, so they cannot call it.
+func writeCompetingLease(client *fake.Clientset, locker *KubeLocker, l *Lock) error {
+	gvr := corev1.SchemeGroupVersion.WithResource("configmaps")
+	obj, err := client.Tracker().Get(gvr, locker.Namespace, locker.GetConfigMapName(l))
+	if err != nil {
+		return err
+	}
+	cmap := obj.(*corev1.ConfigMap).DeepCopy()
+	lockState := &Lock{Name: l.Name}
+	if err := json.Unmarshal([]byte(cmap.Data["lock"]), lockState); err != nil {
+		return err
+	}
+	if err := lockState.grant(l); err != nil {
+		return err
+	}
+	data, err := json.Marshal(lockState)
+	if err != nil {
+		return err
+	}
+	cmap.Data["lock"] = string(data)
+	return client.Tracker().Update(gvr, cmap, locker.Namespace)
+}
+
+func TestKubeLockerConflict(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	locker := NewKubeLocker(client, "default")
+	lockA := NewLock("conflicting", locker).WithDuration(time.Minute)
+	if err := lockA.Acquire(); err != nil {
+		t.Error(err)
+	}
+	if err := lockA.Release(); err != nil {
+		t.Error(err)
+	}
+
+	// another client writes its lease between our read and update
+	lockB := NewLock("conflicting", locker).WithDuration(time.Minute)
+	gets, updates := 0, 0
+	client.PrependReactor("get", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		gets++
+		return false, nil, nil
+	})
+	client.PrependReactor("update", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		updates++
+		if updates > 1 {
+			return false, nil, nil
+		}
+		if err := writeCompetingLease(client, locker, lockB); err != nil {
+			t.Error(err)
+		}
+		return true, nil, apierrors.NewConflict(schema.GroupResource{Resource: "configmaps"}, "lockheed-conflicting", errors.New("object was modified"))
+	})
+	if err := lockA.Acquire(); err == nil {
+		t.Error("Expected acquire to fail after losing the conflict")
+	}
+	if gets != 2 || updates != 1 {
+		t.Errorf("Expected state to be read again after conflict, got %d reads and %d updates", gets, updates)
+	}
+
+	// release is retried until the update goes through
+	releaseUpdates := 0
+	client.PrependReactor("update", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		releaseUpdates++
+		if releaseUpdates > 2 {
+			return false, nil, nil
+		}
+		return true, nil, apierrors.NewConflict(schema.GroupResource{Resource: "configmaps"}, "lockheed-conflicting", errors.New("object was modified"))
+	})
+	if err := lockB.Release(); err != nil {
+		t.Error(err)
+	}
+	if releaseUpdates != 3 {
+		t.Errorf("Expected release to be retried after conflict, got %d updates", releaseUpdates)
+	}
+	locks, err := locker.GetAllLocks()
+	if err != nil {
+		t.Error(err)
+	}
+	if len(locks) != 1 || len(locks[0].Leases) != 0 {
+		t.Error("Expected lease to be released")
+	}
+}
+
+func TestKubeLockerAPIError(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	gets := 0
+	client.PrependReactor("get", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		gets++
+		return true, nil, apierrors.NewForbidden(schema.GroupResource{Resource: "configmaps"}, "lockheed-forbidden", errors.New("RBAC"))
+	})
+	lock := NewLock("forbidden", NewKubeLocker(client, "default")).WithDuration(time.Minute)
+	if err := lock.Acquire(); !apierrors.IsForbidden(err) {
+		t.Errorf("Expected forbidden error, got %v", err)
+	}
+	if gets != 1 {
+		t.Errorf("Expected no retry on API errors, got %d reads", gets)
+	}
+}
+
+func TestKubeLockerConflictExhausted(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	updates := 0
+	client.PrependReactor("create", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		updates++
+		return true, nil, apierrors.NewConflict(schema.GroupResource{Resource: "configmaps"}, "lockheed-busy", errors.New("object was modified"))
+	})
+	lock := NewLock("busy", NewKubeLocker(client, "default")).WithDuration(time.Minute)
+	if err := lock.Acquire(); !errors.Is(err, ErrConflict) {
+		t.Errorf("Expected conflict error, got %v", err)
+	}
+	if updates != kretry.DefaultBackoff.Steps {
+		t.Errorf("Expected %d attempts, got %d", kretry.DefaultBackoff.Steps, updates)
+	}
+}
+
+func TestKubeLockerSlowResponse(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	locker := NewKubeLocker(client, "default")
+	client.PrependReactor("create", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		time.Sleep(200 * time.Millisecond)
+		return false, nil, nil
+	})
+	lock := NewLock("slow", locker).WithDuration(time.Minute)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := lock.AcquireContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+
+	// the lease written by the slow attempt is not left behind
+	locks, err := locker.GetAllLocks()
+	if err != nil {
+		t.Error(err)
+	}
+	if len(locks) != 1 || len(locks[0].Leases) != 0 {
+		t.Error("Expected lease of interrupted acquire to be released")
+	}
+}
+
+func TestKubeLockerWaitForChange(t *testing.T) {
+	locker := NewKubeLocker(fake.NewSimpleClientset(), "default")
+	lockA := NewLock("watched", locker).WithDuration(time.Minute)
+	if err := lockA.Acquire(); err != nil {
+		t.Fatal(err)
+	}
+	lockB := NewLock("watched", locker).WithDuration(time.Minute)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	changed := make(chan error, 1)
+	go func() {
+		changed <- locker.WaitForChange(ctx, lockB)
+	}()
+	select {
+	case err := <-changed:
+		t.Fatalf("Expected to wait while the lock is held, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := lockA.Release(); err != nil {
+		t.Error(err)
+	}
+	select {
+	case err := <-changed:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected release to end the wait")
+	}
+	if err := lockB.Acquire(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestKubeLockerLegacyReservation(t *testing.T) {
+	client := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "lockheed-legacy",
+			Namespace: "default",
+			Labels:    map[string]string{"lockheed/lock": ""},
+			Annotations: map[string]string{
+				legacyReservedByAnnotation:      "old-client",
+				legacyReservedExpiresAnnotation: time.Now().Add(time.Hour).Format(time.RFC3339),
+			},
+		},
+	})
+	locker := NewKubeLocker(client, "default")
+	lock := NewLock("legacy", locker).WithDuration(time.Minute)
+	err := lock.Acquire()
+	if !errors.Is(err, errLegacyReservation) {
+		t.Errorf("Expected legacy reservation to be honored, got %v", err)
+	}
+	var held *LockHeldError
+	if !errors.As(err, &held) || held.InstanceID != "old-client" {
+		t.Errorf("Expected reservation holder in error, got %v", err)
+	}
+
+	cmap, err := locker.GetConfigMap(lock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmap.Annotations[legacyReservedExpiresAnnotation] = time.Now().Add(-time.Second).Format(time.RFC3339)
+	if _, err := client.CoreV1().ConfigMaps("default").Update(context.Background(), cmap, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := lock.Acquire(); err != nil {
+		t.Error(err)
+	}
+	cmap, err = locker.GetConfigMap(lock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, reserved := cmap.Annotations[legacyReservedByAnnotation]; reserved {
+		t.Error("Expected expired legacy reservation to be dropped")
+	}
+}
+
+// stubLocker returns preset errors and records releases
+type stubLocker struct {
+	acquireErr error
+	renewErr   error
+	attempts   int
+	released   int
+}
+
+func (locker *stubLocker) Acquire(l *Lock) error {
+	locker.attempts++
+	return locker.acquireErr
+}
+
+func (locker *stubLocker) Renew(l *Lock) error {
+	return locker.renewErr
+}
+
+func (locker *stubLocker) Release(l *Lock) error {
+	locker.released++
+	return nil
+}
+
+func (locker *stubLocker) GetAllLocks() ([]*Lock, error) {
+	return nil, nil
+}
+
+func TestAcquireContextDeadline(t *testing.T) {
+	locker := &stubLocker{acquireErr: fmt.Errorf("Mutex lock is already held by someone else")}
+	lock := NewLock("contended", locker)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := lock.AcquireContext(ctx, AcquireOptionWithBackoff(100, time.Second, 0, 1))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("Expected acquire to return on deadline")
+	}
+	if locker.released != 1 {
+		t.Error("Expected cleanup of interrupted acquire")
+	}
+}
+
+func TestAcquireRetryBackoff(t *testing.T) {
+	locker := &stubLocker{acquireErr: fmt.Errorf("Mutex lock is already held by someone else")}
+	lock := NewLock("contended", locker)
+	start := time.Now()
+	if err := lock.Acquire(AcquireOptionWithBackoff(3, 10*time.Millisecond, 15*time.Millisecond, 2)); err == nil {
+		t.Error("Failure expected")
+	}
+	if locker.attempts != 3 {
+		t.Errorf("Expected 3 attempts, got %d", locker.attempts)
+	}
+	if elapsed := time.Since(start); elapsed < 25*time.Millisecond || elapsed > time.Second {
+		t.Errorf("Expected attempts to be 10ms then 15ms apart, took %s", elapsed)
+	}
+	if err := lock.Acquire(AcquireOptionWithBackoff(3, time.Millisecond, 0, 0.5)); err == nil {
+		t.Error("Expected backoff factor below 1 to be refused")
+	}
+}
+
+func TestAcquireRetryLogic(t *testing.T) {
+	locker := &stubLocker{acquireErr: fmt.Errorf("Mutex lock is already held by someone else")}
+	lock := NewLock("contended", locker)
+	rl, _ := retry.NewRetryLogic(retry.WithMaxAttempts(3), retry.WithLinearBackoff(time.Millisecond))
+	// the retry logic starts over on every acquisition
+	for i := 1; i <= 2; i++ {
+		if err := lock.Acquire(AcquireOptionWithRetry(rl)); err == nil {
+			t.Error("Failure expected")
+		}
+		if locker.attempts != 3*i {
+			t.Errorf("Expected %d attempts, got %d", 3*i, locker.attempts)
+		}
+	}
+}
+
+func TestLostOnDeletion(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	locker := NewKubeLocker(client, "default")
+	lock := NewLock("deleted", locker).WithDuration(0)
+	if err := lock.Acquire(); err != nil {
+		t.Fatal(err)
+	}
+	cmap, err := locker.GetConfigMap(lock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.CoreV1().ConfigMaps("default").Delete(context.Background(), cmap.Name, metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := lock.Renew(); !errors.Is(err, ErrLockNotFound) {
+		t.Errorf("Expected ErrLockNotFound, got %v", err)
+	}
+	select {
+	case <-lock.Lost():
+	case <-time.After(time.Second):
+		t.Error("Expected hold to be lost along with the lock")
+	}
+	if lock.HeldContext().Err() == nil || lock.State() != LockStateLost {
+		t.Errorf("Expected lost lock, got %s", lock.State())
+	}
+}
+
+func TestLostOnTakeover(t *testing.T) {
+	locker := &stubLocker{}
+	lock := NewLock("lost", locker).WithDuration(time.Hour).WithRenewInterval(10 * time.Millisecond)
+	if err := lock.Acquire(); err != nil {
+		t.Error(err)
+	}
+	held := lock.HeldContext()
+	if held.Err() != nil {
+		t.Error("Expected held context to be active")
+	}
+	lock.Renew()
+	select {
+	case <-lock.Lost():
+		t.Error("Lease lost unexpectedly")
+	default:
+	}
+
+	lock.mutex.Lock()
+	locker.renewErr = fmt.Errorf("No lease to renew: %w", ErrNotHolder)
+	lock.mutex.Unlock()
+	select {
+	case <-lock.Lost():
+	case <-time.After(time.Second):
+		t.Error("Expected lease to be lost")
+	}
+	if held.Err() == nil {
+		t.Error("Expected held context to be cancelled")
+	}
+}
+
+func TestLostOnExpiry(t *testing.T) {
+	lock := NewLock("expired", &stubLocker{}).WithDuration(50 * time.Millisecond)
+	if err := lock.Acquire(); err != nil {
+		t.Error(err)
+	}
+	select {
+	case <-lock.Lost():
+	case <-time.After(time.Second):
+		t.Error("Expected lease to be lost on expiry")
+	}
+}
+
+func TestHeldContextOnRelease(t *testing.T) {
+	lock := NewLock("released", &stubLocker{}).WithDuration(time.Hour)
+	if lock.HeldContext().Err() == nil {
+		t.Error("Expected held context to be done before acquire")
+	}
+	if err := lock.Acquire(); err != nil {
+		t.Error(err)
+	}
+	held := lock.HeldContext()
+	if err := lock.Release(); err != nil {
+		t.Error(err)
+	}
+	if held.Err() == nil {
+		t.Error("Expected held context to be cancelled on release")
+	}
+	select {
+	case <-lock.Lost():
+		t.Error("Release should not count as lost lease")
+	default:
+	}
+}
+
+func TestReentrantHold(t *testing.T) {
+	lock := NewLock("reentrant", &stubLocker{}).WithDuration(time.Hour).WithReentrant()
+	lock.Acquire()
+	lock.Acquire()
+	lock.Release()
+	if lock.HeldContext().Err() != nil {
+		t.Error("Expected lock to be held after first release")
+	}
+	lock.Release()
+	if lock.HeldContext().Err() == nil {
+		t.Error("Expected hold to end after second release")
+	}
+}
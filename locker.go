@@ -1,5 +1,11 @@
 package lockheed
 
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
 type LockerInterface interface {
 	Acquire(*Lock) error
 	Renew(*Lock) error
@@ -9,17 +15,37 @@ type LockerInterface interface {
 	// ForcefulRemoval(string, []Condition)
 }
 
+// WatcherInterface is implemented by lockers able to notify waiters about lock state changes
+type WatcherInterface interface {
+	// WaitForChange blocks until the lock might be acquirable by l, that is until its
+	// state changes, a lease on it expires or ctx is done
+	WaitForChange(ctx context.Context, l *Lock) error
+}
+
+// FilteringLockerInterface is implemented by lockers able to evaluate conditions, at least
+// partially, within their storage. The returned locks might still not match the condition.
+type FilteringLockerInterface interface {
+	GetMatchingLocks(c *Condition) ([]*Lock, error)
+}
+
 func GetLocks(locker LockerInterface, c *Condition) ([]*Lock, error) {
 	var result []*Lock
-	locks, err := locker.GetAllLocks()
+	var locks []*Lock
+	var err error
+	if filtering, ok := locker.(FilteringLockerInterface); ok && c != nil {
+		locks, err = filtering.GetMatchingLocks(c)
+	} else {
+		locks, err = locker.GetAllLocks()
+	}
 	if err != nil {
 		return nil, err
 	}
 	if c == nil {
 		result = locks
 	} else {
+		now := lockerClock(locker).Now()
 		for _, lock := range locks {
-			matching, err := lock.Evaluate(c)
+			matching, err := lock.evaluate(c, now)
 			if err != nil {
 				return nil, err
 			}
@@ -30,3 +56,16 @@ func GetLocks(locker LockerInterface, c *Condition) ([]*Lock, error) {
 	}
 	return result, nil
 }
+
+// backoffWait waits after given failed attempt of a conditional write for a random delay of
+// up to attempt times step, so that competing clients do not keep colliding in lockstep
+func backoffWait(ctx context.Context, attempt int, step time.Duration) error {
+	timer := time.NewTimer(time.Duration(rand.Int63n(int64(attempt) * int64(step))))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
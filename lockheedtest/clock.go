@@ -0,0 +1,97 @@
+// Package lockheedtest provides helpers for testing code built on lockheed
+package lockheedtest
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// FakeClock is a clock whose time only moves when told to, it implements lockheed.Clock.
+// Functions scheduled with AfterFunc are called in their own goroutines as soon as the
+// time is advanced past their deadline.
+type FakeClock struct {
+	mutex   sync.Mutex
+	now     time.Time
+	waiters []*fakeWaiter
+}
+
+type fakeWaiter struct {
+	at time.Time
+	f  func()
+}
+
+// NewFakeClock returns a fake clock set to given time
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+// AfterFunc schedules f to be called once the clock is advanced by d
+func (c *FakeClock) AfterFunc(d time.Duration, f func()) func() bool {
+	if d <= 0 {
+		go f()
+		return func() bool { return false }
+	}
+	c.mutex.Lock()
+	w := &fakeWaiter{at: c.now.Add(d), f: f}
+	c.waiters = append(c.waiters, w)
+	c.mutex.Unlock()
+	return func() bool {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		for i, waiter := range c.waiters {
+			if waiter == w {
+				c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Advance moves the clock forward by d, calling all functions scheduled until then
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	c.set(c.now.Add(d))
+}
+
+// Set moves the clock to given time, calling all functions scheduled until then
+func (c *FakeClock) Set(now time.Time) {
+	c.mutex.Lock()
+	c.set(now)
+}
+
+// set runs with the clock mutex held and releases it
+func (c *FakeClock) set(now time.Time) {
+	c.now = now
+	var due, pending []*fakeWaiter
+	for _, w := range c.waiters {
+		if now.Before(w.at) {
+			pending = append(pending, w)
+		} else {
+			due = append(due, w)
+		}
+	}
+	c.waiters = pending
+	c.mutex.Unlock()
+	sort.SliceStable(due, func(i, j int) bool {
+		return due[i].at.Before(due[j].at)
+	})
+	for _, w := range due {
+		go w.f()
+	}
+}
+
+// Waiters returns the number of scheduled functions not called yet, useful to wait
+// until the code under test scheduled its timers before advancing the clock
+func (c *FakeClock) Waiters() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.waiters)
+}
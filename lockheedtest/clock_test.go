@@ -0,0 +1,38 @@
+package lockheedtest
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	fired := make(chan time.Time, 2)
+	clock.AfterFunc(time.Minute, func() {
+		fired <- clock.Now()
+	})
+	stop := clock.AfterFunc(time.Hour, func() {
+		t.Error("Stopped function called")
+	})
+
+	clock.Advance(30 * time.Second)
+	if len(fired) != 0 || clock.Waiters() != 2 {
+		t.Error("Expected nothing to be called before the deadline")
+	}
+	if !stop() || clock.Waiters() != 1 {
+		t.Error("Expected function to be stopped")
+	}
+	clock.Advance(2 * time.Hour)
+	select {
+	case at := <-fired:
+		if !at.Equal(start.Add(2*time.Hour + 30*time.Second)) {
+			t.Errorf("Unexpected time %s", at)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected function to be called")
+	}
+	if clock.Waiters() != 0 {
+		t.Error("Expected no scheduled functions left")
+	}
+}
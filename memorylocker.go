@@ -0,0 +1,142 @@
+package lockheed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryLocker keeps lock state within the memory of the current process. State is
+// stored serialized the same way other lockers do, so it is never shared with callers.
+type MemoryLocker struct {
+	locks   map[string][]byte
+	changed chan struct{}
+	mutex   sync.Mutex
+	Clock   Clock
+}
+
+func NewMemoryLocker() *MemoryLocker {
+	return &MemoryLocker{
+		locks:   make(map[string][]byte),
+		changed: make(chan struct{}),
+	}
+}
+
+// modify runs fn on the state of the lock under the locker mutex. A missing lock is
+// created only if create is set.
+func (locker *MemoryLocker) modify(l *Lock, create bool, fn func(lockState *Lock) error) error {
+	locker.mutex.Lock()
+	defer locker.mutex.Unlock()
+
+	data, exists := locker.locks[l.Name]
+	if !exists && !create {
+		return fmt.Errorf("Lock %s does not exist: %w", l.Name, ErrLockNotFound)
+	}
+	lockState := &Lock{Name: l.Name}
+	if exists {
+		if err := decodeLockState(data, lockState); err != nil {
+			return err
+		}
+	}
+
+	updated, changed, err := applyChange(lockState, fn)
+	if updated != nil && (!exists || changed) {
+		locker.locks[l.Name] = updated
+		close(locker.changed)
+		locker.changed = make(chan struct{})
+	}
+	return err
+}
+
+func (locker *MemoryLocker) GetAllLocks() ([]*Lock, error) {
+	locker.mutex.Lock()
+	defer locker.mutex.Unlock()
+	var names []string
+	for name := range locker.locks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var result []*Lock
+	for _, name := range names {
+		lockState := &Lock{}
+		if err := decodeLockState(locker.locks[name], lockState); err != nil {
+			return result, err
+		}
+		result = append(result, lockState)
+	}
+	return result, nil
+}
+
+func (locker *MemoryLocker) GetLock(name string) (*Lock, error) {
+	locker.mutex.Lock()
+	defer locker.mutex.Unlock()
+	data, exists := locker.locks[name]
+	if !exists {
+		return nil, fmt.Errorf("Lock %s does not exist: %w", name, ErrLockNotFound)
+	}
+	lockState := &Lock{}
+	if err := decodeLockState(data, lockState); err != nil {
+		return nil, err
+	}
+	return lockState, nil
+}
+
+func (locker *MemoryLocker) Acquire(l *Lock) error {
+	return locker.modify(l, true, func(lockState *Lock) error {
+		return lockState.grant(l)
+	})
+}
+
+func (locker *MemoryLocker) Renew(l *Lock) error {
+	return locker.modify(l, false, func(lockState *Lock) error {
+		return lockState.renew(l)
+	})
+}
+
+func (locker *MemoryLocker) Release(l *Lock) error {
+	return locker.modify(l, false, func(lockState *Lock) error {
+		lockState.release(l)
+		return nil
+	})
+}
+
+// WaitForChange returns as soon as the state of any lock changes or a lease on
+// the lock of l expires
+func (locker *MemoryLocker) WaitForChange(ctx context.Context, l *Lock) error {
+	locker.mutex.Lock()
+	changed := locker.changed
+	lockState := &Lock{Name: l.Name}
+	if data, exists := locker.locks[l.Name]; exists {
+		if err := decodeLockState(data, lockState); err != nil {
+			locker.mutex.Unlock()
+			return err
+		}
+	}
+	locker.mutex.Unlock()
+
+	expiry, expiring := lockState.nextExpiry(l)
+	if err := lockState.admit(l); err == nil || !errors.Is(err, ErrLockHeld) {
+		return err
+	}
+	var expired <-chan time.Time
+	if expiring {
+		var stop func() bool
+		expired, stop = clockTimer(l.clock(), expiry.Sub(l.clock().Now()))
+		defer stop()
+	}
+	select {
+	case <-changed:
+		return nil
+	case <-expired:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (locker *MemoryLocker) clock() Clock {
+	return clockOrReal(locker.Clock)
+}
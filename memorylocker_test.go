@@ -0,0 +1,187 @@
+package lockheed
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMemoryLockerForce(t *testing.T) {
+	locker := NewMemoryLocker()
+	lockA := NewLock("testlockx", locker).WithDuration(5 * time.Second).WithTags([]string{"forceme"})
+	if err := lockA.Acquire(); err != nil {
+		t.Error(err)
+	}
+	lockB := NewLock("testlockx", locker).WithDuration(5 * time.Second)
+	if err := lockB.Acquire(); err == nil {
+		t.Error("Failure expected")
+	}
+
+	lockC := NewLock("testlockx", locker).
+		WithDuration(30 * time.Second).
+		WithResetTags().
+		WithForce(Condition{
+			Operation: OperationContains,
+			Field:     FieldTags,
+			Value:     "forceme",
+		})
+	if err := lockC.Acquire(); err != nil {
+		t.Error(err)
+	}
+	lockD := NewLock("testlockx", locker).
+		WithDuration(30 * time.Second).
+		WithResetTags().
+		WithForce(Condition{
+			Operation: OperationContains,
+			Field:     FieldTags,
+			Value:     "forceme",
+		})
+	if err := lockD.Acquire(); err == nil {
+		t.Error("Failure expected")
+	}
+}
+
+func TestMemoryLocker(t *testing.T) {
+	locker := NewMemoryLocker()
+	lockA := NewLock("testlock", locker).
+		WithDuration(10 * time.Second).
+		WithTags([]string{"testtag"})
+	if err := lockA.Acquire(); err != nil {
+		t.Error(err)
+	}
+	lockB := NewLock("testlock", locker).
+		WithDuration(10 * time.Second).
+		WithTags([]string{"testtag"})
+	if err := lockB.AcquireRetry(2, 2); err == nil {
+		t.Error("Expected to fail")
+	}
+	lockC := NewLock("testlock2", locker).
+		WithDuration(10 * time.Second).
+		WithTags([]string{"testtag"})
+	if err := lockC.AcquireRetry(5, 3); err != nil {
+		t.Error(err)
+	}
+	if err := lockA.Release(); err != nil {
+		t.Error(err)
+	}
+	if err := lockB.Acquire(); err != nil {
+		t.Error(err)
+	}
+	if err := lockB.Release(); err != nil {
+		t.Error(err)
+	}
+
+	cond := &Condition{
+		Operation: OperationAnd,
+		Conditions: &[]Condition{
+			Condition{
+				Operation: OperationEquals,
+				Field:     FieldAcquired,
+				Value:     true,
+			},
+			Condition{
+				Operation: OperationContains,
+				Field:     FieldTags,
+				Value:     "testtag",
+			},
+		},
+	}
+
+	locks, err := GetLocks(locker, cond)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(locks) != 1 || locks[0].Name != "testlock2" {
+		t.Error("Lock not listed as expected")
+	}
+
+	if err := lockC.Release(); err != nil {
+		t.Error(err)
+	}
+	if err := lockC.Release(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMemoryLockerExpiry(t *testing.T) {
+	locker := NewMemoryLocker()
+	lockA := NewLock("expiring", locker).WithDuration(50 * time.Millisecond)
+	if err := lockA.Acquire(); err != nil {
+		t.Error(err)
+	}
+	lockB := NewLock("expiring", locker).WithDuration(time.Second)
+	if err := lockB.Acquire(); err == nil {
+		t.Error("Failure expected")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if err := lockB.Acquire(); err != nil {
+		t.Error(err)
+	}
+	if err := lockA.Renew(); err == nil {
+		t.Error("Expected renewal of expired lease to fail")
+	}
+}
+
+func TestMemoryLockerCorruptState(t *testing.T) {
+	locker := NewMemoryLocker()
+	locker.locks["corrupt"] = []byte("{")
+	if err := NewLock("corrupt", locker).Acquire(); !errors.Is(err, ErrCorruptState) {
+		t.Errorf("Expected ErrCorruptState, got %v", err)
+	}
+	if err := NewLock("missing", locker).Release(); !errors.Is(err, ErrLockNotFound) {
+		t.Errorf("Expected ErrLockNotFound, got %v", err)
+	}
+}
+
+func TestMemoryLockerWatch(t *testing.T) {
+	locker := NewMemoryLocker()
+	lockA := NewLock("watched", locker).WithDuration(time.Minute)
+	if err := lockA.Acquire(); err != nil {
+		t.Error(err)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		lockA.Release()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	lockB := NewLock("watched", locker).WithDuration(time.Minute)
+	if err := lockB.AcquireContext(ctx, AcquireOptionWithWatch()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMemoryLockerWatchMismatch(t *testing.T) {
+	locker := NewMemoryLocker()
+	if err := NewLock("watched", locker).WithDuration(time.Minute).Acquire(); err != nil {
+		t.Error(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	lock := NewLock("watched", locker).WithDuration(time.Minute).WithLockType(LockTypeShared)
+	if err := lock.AcquireContext(ctx, AcquireOptionWithWatch()); err == nil || errors.Is(err, ErrLockHeld) {
+		t.Errorf("Expected type mismatch to be reported, got %v", err)
+	}
+	if ctx.Err() != nil {
+		t.Error("Expected type mismatch to be reported without waiting")
+	}
+}
+
+func TestMemoryLockerQueueAbandoned(t *testing.T) {
+	locker := NewMemoryLocker()
+	holder := NewLock("queued", locker).WithDuration(time.Minute)
+	if err := holder.Acquire(); err != nil {
+		t.Error(err)
+	}
+	if err := NewLock("queued", locker).WithDuration(time.Minute).WithQueue(time.Minute).Acquire(); err == nil {
+		t.Error("Expected lock to be held")
+	}
+	if err := holder.Release(); err != nil {
+		t.Error(err)
+	}
+	// the waiter gave up, its ticket does not block others
+	if err := NewLock("queued", locker).WithDuration(time.Minute).Acquire(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,207 @@
+package lockheed
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// quorumDriftMargin is added to the drift allowance of every quorum acquisition
+const quorumDriftMargin = 2 * time.Millisecond
+
+// QuorumLocker spreads every lock over several independent lockers and considers it
+// acquired only when a majority of them granted the lease within its validity window,
+// so the lock survives the loss of a minority of its backends.
+type QuorumLocker struct {
+	Lockers []LockerInterface
+	// DriftFactor is the share of the lease duration reserved for clock drift between backends
+	DriftFactor float64
+	Clock       Clock
+}
+
+func NewQuorumLocker(lockers ...LockerInterface) *QuorumLocker {
+	locker := &QuorumLocker{
+		Lockers:     lockers,
+		DriftFactor: 0.01,
+	}
+	return locker
+}
+
+// quorum returns the number of lockers forming a majority
+func (locker *QuorumLocker) quorum() int {
+	return len(locker.Lockers)/2 + 1
+}
+
+// each runs fn for all lockers concurrently and returns their errors in the order of the lockers
+func (locker *QuorumLocker) each(fn func(backend LockerInterface, i int) error) []error {
+	errs := make([]error, len(locker.Lockers))
+	var wg sync.WaitGroup
+	for i, backend := range locker.Lockers {
+		wg.Add(1)
+		go func(backend LockerInterface, i int) {
+			defer wg.Done()
+			errs[i] = fn(backend, i)
+		}(backend, i)
+	}
+	wg.Wait()
+	return errs
+}
+
+// tally returns the number of successful calls along with the first error seen
+func tally(errs []error) (int, error) {
+	succeeded := 0
+	var first error
+	for _, err := range errs {
+		if err == nil {
+			succeeded++
+		} else if first == nil {
+			first = err
+		}
+	}
+	return succeeded, first
+}
+
+// validity returns how long a lease written by calls started at given time can still be
+// relied on, accounting for the time the calls took and for clock drift between backends
+func (locker *QuorumLocker) validity(l *Lock, started time.Time) time.Duration {
+	if l.Duration == 0 {
+		return time.Duration(1<<63 - 1)
+	}
+	drift := time.Duration(float64(l.Duration)*locker.DriftFactor) + quorumDriftMargin
+	return l.Duration - l.clock().Now().Sub(started) - drift
+}
+
+// Acquire requests the lease from all lockers and rolls back every acquisition if no
+// majority granted it in time. Fencing tokens are issued independently by each locker
+// and are not comparable, so the lock does not carry one.
+func (locker *QuorumLocker) Acquire(l *Lock) error {
+	started := l.clock().Now()
+	held := l.isHeld()
+	errs := locker.each(func(backend LockerInterface, i int) error {
+		return backend.Acquire(l)
+	})
+	granted, err := tally(errs)
+	validity := locker.validity(l, started)
+	if granted >= locker.quorum() && validity > 0 {
+		l.setFencingToken(0)
+		return nil
+	}
+
+	// roll back what this attempt changed. Unless the lock was held already, release
+	// everywhere, as failed attempts may have left pending requests or queue tickets.
+	// While held, only the extra hold of a reentrant lease is undone, releasing the lease
+	// itself would drop it from under the current hold.
+	locker.each(func(backend LockerInterface, i int) error {
+		if held && (errs[i] != nil || !l.Reentrant) {
+			return nil
+		}
+		return backend.Release(l)
+	})
+	if granted >= locker.quorum() {
+		return fmt.Errorf("Lock %s acquired on %d of %d lockers, but not within its validity window", l.Name, granted, len(locker.Lockers))
+	}
+	return fmt.Errorf("Lock %s acquired on %d of %d lockers, %d required: %w", l.Name, granted, len(locker.Lockers), locker.quorum(), err)
+}
+
+// Renew extends the lease on all lockers and succeeds if a majority renewed it in time.
+// The lease is considered lost once too many lockers report it lost to reach a majority.
+func (locker *QuorumLocker) Renew(l *Lock) error {
+	started := l.clock().Now()
+	errs := locker.each(func(backend LockerInterface, i int) error {
+		return backend.Renew(l)
+	})
+	renewed, _ := tally(errs)
+	if renewed >= locker.quorum() {
+		if locker.validity(l, started) <= 0 {
+			return fmt.Errorf("Lock %s renewed on %d of %d lockers, but not within its validity window", l.Name, renewed, len(locker.Lockers))
+		}
+		return nil
+	}
+
+	// report the lease lost only when too few lockers are left to ever reach a majority
+	lost := 0
+	var lostErr, otherErr error
+	for _, e := range errs {
+		switch {
+		case isLeaseLost(e):
+			lost++
+			if lostErr == nil {
+				lostErr = e
+			}
+		case e != nil && otherErr == nil:
+			otherErr = e
+		}
+	}
+	err := otherErr
+	if len(locker.Lockers)-lost < locker.quorum() {
+		err = lostErr
+	}
+	return fmt.Errorf("Lock %s renewed on %d of %d lockers, %d required: %w", l.Name, renewed, len(locker.Lockers), locker.quorum(), err)
+}
+
+// Release drops the lease from all lockers, leases on lockers not reachable expire on their own
+func (locker *QuorumLocker) Release(l *Lock) error {
+	released, err := tally(locker.each(func(backend LockerInterface, i int) error {
+		return backend.Release(l)
+	}))
+	if released < locker.quorum() {
+		return fmt.Errorf("Lock %s released on %d of %d lockers: %w", l.Name, released, len(locker.Lockers), err)
+	}
+	return nil
+}
+
+// GetAllLocks merges the locks listed by all lockers, keeping the leases present on a
+// majority of them with their earliest expiry
+func (locker *QuorumLocker) GetAllLocks() ([]*Lock, error) {
+	lists := make([][]*Lock, len(locker.Lockers))
+	listed, err := tally(locker.each(func(backend LockerInterface, i int) error {
+		var err error
+		lists[i], err = backend.GetAllLocks()
+		return err
+	}))
+	if listed < locker.quorum() {
+		return nil, fmt.Errorf("Locks listed by %d of %d lockers: %w", listed, len(locker.Lockers), err)
+	}
+
+	var result []*Lock
+	merged := make(map[string]*Lock)
+	seen := make(map[string]map[string]int)
+	for _, locks := range lists {
+		for _, lockState := range locks {
+			lock, exists := merged[lockState.Name]
+			if !exists {
+				lock = &Lock{Name: lockState.Name, LockType: lockState.LockType, Leases: make(map[string]LockLease)}
+				lock.MaxLeases = lockState.MaxLeases
+				merged[lockState.Name] = lock
+				seen[lockState.Name] = make(map[string]int)
+				result = append(result, lock)
+			}
+			if t := lockState.Transitioned; t != nil && (lock.Transitioned == nil || lock.Transitioned.Before(*t)) {
+				lock.transition(*t)
+			}
+			for _, tag := range lockState.Tags {
+				if !stringInSlice(lock.Tags, tag) {
+					lock.Tags = append(lock.Tags, tag)
+				}
+			}
+			for key, lease := range lockState.Leases {
+				seen[lockState.Name][key]++
+				if current, exists := lock.Leases[key]; !exists || lease.Expires.Before(current.Expires) {
+					lock.Leases[key] = lease
+				}
+			}
+		}
+	}
+	for name, lock := range merged {
+		for key := range lock.Leases {
+			if seen[name][key] < locker.quorum() {
+				delete(lock.Leases, key)
+			}
+		}
+	}
+	return result, nil
+}
+
+func (locker *QuorumLocker) clock() Clock {
+	return clockOrReal(locker.Clock)
+}
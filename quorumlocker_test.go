@@ -0,0 +1,145 @@
+package lockheed
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestQuorumLocker(t *testing.T) {
+	backends := []*MemoryLocker{NewMemoryLocker(), NewMemoryLocker(), NewMemoryLocker()}
+	locker := NewQuorumLocker(backends[0], backends[1], backends[2])
+
+	// a lease held directly on a single backend does not prevent a majority
+	other := NewLock("quorum", backends[0]).WithDuration(time.Minute)
+	if err := other.Acquire(); err != nil {
+		t.Error(err)
+	}
+	lockA := NewLock("quorum", locker).WithDuration(time.Minute).WithTags([]string{"multi"})
+	if err := lockA.Acquire(); err != nil {
+		t.Error(err)
+	}
+	lockB := NewLock("quorum", locker).WithDuration(time.Minute)
+	if err := lockB.Acquire(); err == nil {
+		t.Error("Failure expected")
+	}
+	if err := lockA.Renew(); err != nil {
+		t.Error(err)
+	}
+
+	locks, err := locker.GetAllLocks()
+	if err != nil {
+		t.Error(err)
+	}
+	if len(locks) != 1 || len(locks[0].Leases) != 1 || locks[0].Leases[lockA.InstanceID].InstanceID != lockA.InstanceID {
+		t.Error("Expected merged lock with the quorum lease only")
+	}
+
+	if err := lockA.Release(); err != nil {
+		t.Error(err)
+	}
+	if err := lockB.Acquire(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestQuorumLockerRollback(t *testing.T) {
+	backends := []*MemoryLocker{NewMemoryLocker(), NewMemoryLocker(), NewMemoryLocker()}
+	locker := NewQuorumLocker(backends[0], backends[1], backends[2])
+	for _, backend := range backends[:2] {
+		if err := NewLock("contended", backend).WithDuration(time.Minute).Acquire(); err != nil {
+			t.Error(err)
+		}
+	}
+	lock := NewLock("contended", locker).WithDuration(time.Minute)
+	if err := lock.Acquire(); err == nil {
+		t.Error("Failure expected")
+	}
+	locks, err := backends[2].GetAllLocks()
+	if err != nil {
+		t.Error(err)
+	}
+	if len(locks) != 1 || len(locks[0].Leases) != 0 {
+		t.Error("Expected partial acquisition to be rolled back")
+	}
+}
+
+// failingLocker fails acquisitions on the wrapped locker while fail is set
+type failingLocker struct {
+	LockerInterface
+	fail bool
+}
+
+func (locker *failingLocker) Acquire(l *Lock) error {
+	if locker.fail {
+		return fmt.Errorf("unavailable")
+	}
+	return locker.LockerInterface.Acquire(l)
+}
+
+func TestQuorumLockerFailedReacquire(t *testing.T) {
+	backends := []*failingLocker{{LockerInterface: NewMemoryLocker()}, {LockerInterface: NewMemoryLocker()}, {LockerInterface: NewMemoryLocker()}}
+	locker := NewQuorumLocker(backends[0], backends[1], backends[2])
+	lock := NewLock("reacquired", locker).WithDuration(time.Minute)
+	if err := lock.Acquire(); err != nil {
+		t.Fatal(err)
+	}
+	backends[0].fail, backends[1].fail = true, true
+	if err := lock.Acquire(); err == nil {
+		t.Error("Failure expected")
+	}
+	if lock.State() != LockStateHeld {
+		t.Errorf("Expected lock to stay held, got %s", lock.State())
+	}
+	for i, backend := range backends {
+		locks, err := backend.GetAllLocks()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(locks) != 1 || len(locks[0].Leases) != 1 {
+			t.Errorf("Expected lease to be kept on locker %d", i)
+		}
+	}
+	backends[0].fail, backends[1].fail = false, false
+	if err := NewLock("reacquired", locker).WithDuration(time.Minute).Acquire(); err == nil {
+		t.Error("Expected lock to be held by a single instance")
+	}
+}
+
+func TestQuorumLockerUnavailable(t *testing.T) {
+	down := &stubLocker{acquireErr: fmt.Errorf("unavailable"), renewErr: fmt.Errorf("unavailable")}
+	locker := NewQuorumLocker(NewMemoryLocker(), NewMemoryLocker(), down)
+	lock := NewLock("available", locker).WithDuration(time.Minute)
+	if err := lock.Acquire(); err != nil {
+		t.Error(err)
+	}
+	if err := lock.Renew(); err != nil {
+		t.Error(err)
+	}
+
+	downB := &stubLocker{acquireErr: fmt.Errorf("unavailable")}
+	minority := NewQuorumLocker(NewMemoryLocker(), down, downB)
+	if err := NewLock("unavailable", minority).WithDuration(time.Minute).Acquire(); err == nil {
+		t.Error("Expected acquire without majority to fail")
+	}
+	if down.released != 1 || downB.released != 1 {
+		t.Error("Expected rollback on all lockers")
+	}
+}
+
+func TestQuorumLockerLost(t *testing.T) {
+	backends := []*MemoryLocker{NewMemoryLocker(), NewMemoryLocker(), NewMemoryLocker()}
+	locker := NewQuorumLocker(backends[0], backends[1], backends[2])
+	lock := NewLock("lost", locker).WithDuration(time.Minute)
+	if err := lock.Acquire(); err != nil {
+		t.Error(err)
+	}
+	for _, backend := range backends[:2] {
+		if err := backend.Release(lock); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := lock.Renew(); !isLeaseLost(err) {
+		t.Errorf("Expected lease lost, got %v", err)
+	}
+}
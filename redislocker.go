@@ -0,0 +1,212 @@
+package lockheed
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+const (
+	// redisMaxAttempts bounds the number of compare-and-swap attempts of a single operation
+	redisMaxAttempts = 10
+	// redisBackoff is the step by which the random delay between attempts grows
+	redisBackoff = 5 * time.Millisecond
+	// redisGuardTTL bounds how long the guard of a lock outlives a client failing to give it up
+	redisGuardTTL = 2 * time.Second
+)
+
+// redisUnguardScript deletes the guard of a lock if it still holds the given token
+var redisUnguardScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// redisStoreScript stores the lock state only if it still has the version it was read at,
+// registering the lock in the index set used for listing. It returns 1 on success, 0 when
+// the state changed in the meantime.
+var redisStoreScript = redis.NewScript(`
+local version = redis.call('HGET', KEYS[1], 'version')
+if not version then
+	version = '0'
+end
+if version ~= ARGV[1] then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'state', ARGV[2], 'version', tostring(tonumber(version) + 1))
+redis.call('SADD', KEYS[2], ARGV[3])
+return 1
+`)
+
+// RedisLocker stores lock state as JSON in a Redis hash along with a version. Operations on
+// a lock are serialized by a short lived guard key, decisions are taken on the state read at
+// a given version and stored by a server side script, which atomically checks that nobody
+// changed the state in between, should the guard have expired.
+type RedisLocker struct {
+	Client redis.UniversalClient
+	Prefix string
+	Clock  Clock
+}
+
+func NewRedisLocker(client redis.UniversalClient) *RedisLocker {
+	return &RedisLocker{
+		Client: client,
+		Prefix: "lockheed:",
+	}
+}
+
+func (locker *RedisLocker) GetKey(l *Lock) string {
+	return locker.Prefix + "lock:" + l.Name
+}
+
+func (locker *RedisLocker) getIndexKey() string {
+	return locker.Prefix + "locks"
+}
+
+func (locker *RedisLocker) getGuardKey(l *Lock) string {
+	return locker.Prefix + "guard:" + l.Name
+}
+
+// guarded runs modify while holding the guard of the lock, so that clients operating on the
+// same lock take turns instead of failing each other's compare-and-swap. Waiting for the
+// guard only ends with the operation context, a guard left behind expires on its own.
+func (locker *RedisLocker) guarded(l *Lock, create bool, fn func(lockState *Lock) error) error {
+	ctx := l.OperationContext()
+	key := locker.getGuardKey(l)
+	token := uuid.New().String()
+	for {
+		taken, err := locker.Client.SetNX(ctx, key, token, redisGuardTTL).Result()
+		if err != nil {
+			return err
+		}
+		if taken {
+			break
+		}
+		// the guard is held for a few round trips only, keep polling it often
+		if err := backoffWait(ctx, 1, redisBackoff); err != nil {
+			return err
+		}
+	}
+	defer redisUnguardScript.Run(locker.Client.Context(), locker.Client, []string{key}, token)
+	return locker.modify(l, create, fn)
+}
+
+// modify runs fn on the state of the lock and stores it by the store script, retrying after
+// a growing random delay when the state changed since it was read. A missing lock is
+// created only if create is set.
+func (locker *RedisLocker) modify(l *Lock, create bool, fn func(lockState *Lock) error) error {
+	ctx := l.OperationContext()
+	key := locker.GetKey(l)
+	for attempt := 1; ; attempt++ {
+		values, err := locker.Client.HMGet(ctx, key, "state", "version").Result()
+		if err != nil {
+			return err
+		}
+		data, exists := values[0].(string)
+		if !exists && !create {
+			return fmt.Errorf("Lock %s does not exist: %w", l.Name, ErrLockNotFound)
+		}
+		version := "0"
+		if v, ok := values[1].(string); ok {
+			version = v
+		}
+		lockState := &Lock{Name: l.Name}
+		if exists {
+			if err := decodeLockState([]byte(data), lockState); err != nil {
+				return err
+			}
+		}
+
+		updated, changed, fnErr := applyChange(lockState, fn)
+		if updated == nil || (exists && !changed) {
+			return fnErr
+		}
+
+		stored, err := redisStoreScript.Run(ctx, locker.Client, []string{key, locker.getIndexKey()}, version, string(updated), l.Name).Int()
+		if err != nil {
+			return err
+		}
+		if stored == 1 {
+			return fnErr
+		}
+		if attempt >= redisMaxAttempts {
+			return fmt.Errorf("Lock %s changed during %d attempts: %w", l.Name, attempt, ErrConflict)
+		}
+		if err := backoffWait(ctx, attempt, redisBackoff); err != nil {
+			return err
+		}
+	}
+}
+
+func (locker *RedisLocker) GetAllLocks() ([]*Lock, error) {
+	var result []*Lock
+	ctx := locker.Client.Context()
+	names, err := locker.Client.SMembers(ctx, locker.getIndexKey()).Result()
+	if err != nil {
+		return result, err
+	}
+	for _, name := range names {
+		data, err := locker.Client.HGet(ctx, locker.GetKey(&Lock{Name: name}), "state").Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return result, err
+		}
+		lockState := &Lock{}
+		if err := decodeLockState([]byte(data), lockState); err != nil {
+			return result, err
+		}
+		result = append(result, lockState)
+	}
+	return result, nil
+}
+
+func (locker *RedisLocker) GetLock(name string) (*Lock, error) {
+	data, err := locker.Client.HGet(locker.Client.Context(), locker.GetKey(&Lock{Name: name}), "state").Result()
+	if err == redis.Nil {
+		return nil, fmt.Errorf("Lock %s does not exist: %w", name, ErrLockNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	lockState := &Lock{}
+	if err := decodeLockState([]byte(data), lockState); err != nil {
+		return nil, err
+	}
+	return lockState, nil
+}
+
+func (locker *RedisLocker) Acquire(l *Lock) error {
+	return locker.guarded(l, true, func(lockState *Lock) error {
+		return lockState.grant(l)
+	})
+}
+
+func (locker *RedisLocker) Renew(l *Lock) error {
+	return locker.guarded(l, false, func(lockState *Lock) error {
+		return lockState.renew(l)
+	})
+}
+
+// Release keeps retrying while the state keeps changing, as giving up would leave the lease
+// behind until it expires
+func (locker *RedisLocker) Release(l *Lock) error {
+	for {
+		err := locker.guarded(l, false, func(lockState *Lock) error {
+			lockState.release(l)
+			return nil
+		})
+		if !errors.Is(err, ErrConflict) {
+			return err
+		}
+	}
+}
+
+func (locker *RedisLocker) clock() Clock {
+	return clockOrReal(locker.Clock)
+}
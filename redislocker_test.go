@@ -0,0 +1,172 @@
+package lockheed
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+func TestRedisLocker(t *testing.T) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+	locker := NewRedisLocker(client)
+
+	lockA := NewLock("testlock", locker).WithDuration(10 * time.Second).WithTags([]string{"testtag"})
+	if err := lockA.Acquire(); err != nil {
+		t.Error(err)
+	}
+	lockB := NewLock("testlock", locker).WithDuration(10 * time.Second).WithTags([]string{"othertag"})
+	if err := lockB.Acquire(); err == nil {
+		t.Error("Expected to fail")
+	}
+	if err := lockA.Renew(); err != nil {
+		t.Error(err)
+	}
+	if status, err := lockB.Describe(); err != nil || status.Held || len(status.Holders) != 1 {
+		t.Errorf("Unexpected status %+v: %v", status, err)
+	}
+	lockC := NewLock("testlock2", locker).WithDuration(10 * time.Second).WithTags([]string{"testtag"})
+	if err := lockC.Acquire(); err != nil {
+		t.Error(err)
+	}
+	if err := lockC.Release(); err != nil {
+		t.Error(err)
+	}
+
+	cond := &Condition{
+		Operation: OperationAnd,
+		Conditions: &[]Condition{
+			Condition{Operation: OperationEquals, Field: FieldAcquired, Value: true},
+			Condition{Operation: OperationContains, Field: FieldTags, Value: "testtag"},
+		},
+	}
+	locks, err := GetLocks(locker, cond)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(locks) != 1 || locks[0].Name != "testlock" {
+		t.Error("Lock not listed as expected")
+	}
+
+	if err := lockA.Release(); err != nil {
+		t.Error(err)
+	}
+	if err := lockB.Acquire(); err != nil {
+		t.Error(err)
+	}
+	if err := NewLock("missing", locker).Release(); err == nil {
+		t.Error("Expected release of missing lock to fail")
+	}
+}
+
+func TestRedisLockerConflict(t *testing.T) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+	locker := NewRedisLocker(client)
+
+	lockA := NewLock("conflict", locker).WithDuration(10 * time.Second)
+	lockB := NewLock("conflict", locker).WithDuration(10 * time.Second)
+	// lockB sneaks in between the read and the store of lockA
+	err = locker.modify(lockA, true, func(lockState *Lock) error {
+		if lockState.Leases == nil {
+			if err := lockB.Acquire(); err != nil {
+				t.Error(err)
+			}
+		}
+		return lockState.grant(lockA)
+	})
+	if err == nil {
+		t.Error("Expected lockA to see the lease of lockB on retry")
+	}
+}
+
+func TestRedisLockerConflictExhausted(t *testing.T) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+	locker := NewRedisLocker(client)
+
+	lock := NewLock("busy", locker).WithDuration(10 * time.Second)
+	attempts := 0
+	// the state changes between every read and store
+	err = locker.modify(lock, true, func(lockState *Lock) error {
+		attempts++
+		client.HIncrBy(client.Context(), locker.GetKey(lock), "version", 1)
+		return lockState.grant(lock)
+	})
+	if !errors.Is(err, ErrConflict) {
+		t.Errorf("Expected ErrConflict, got %v", err)
+	}
+	if attempts != redisMaxAttempts {
+		t.Errorf("Expected %d attempts, got %d", redisMaxAttempts, attempts)
+	}
+}
+
+func TestRedisLockerContention(t *testing.T) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+	locker := NewRedisLocker(client)
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	acquired, conflicts := 0, 0
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				lock := NewLock("shared", locker).WithDuration(time.Minute).WithLockType(LockTypeSemaphore).WithMaxLeases(100)
+				err := lock.Acquire()
+				mutex.Lock()
+				if err == nil {
+					acquired++
+				} else if errors.Is(err, ErrConflict) {
+					conflicts++
+				} else {
+					t.Error(err)
+				}
+				mutex.Unlock()
+				if err != nil {
+					continue
+				}
+				if err := lock.Release(); err != nil {
+					t.Errorf("Expected release to succeed, got %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if acquired != 150 {
+		t.Errorf("Expected all acquisitions to succeed, %d failed with a conflict", conflicts)
+	}
+	lockState, err := locker.GetLock("shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lockState.Leases) != 0 {
+		t.Errorf("Expected all leases to be released, %d left", len(lockState.Leases))
+	}
+}
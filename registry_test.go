@@ -0,0 +1,128 @@
+package lockheed
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lockheed-registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	locker, err := Open("file://" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fileLocker, ok := locker.(*FileLocker); !ok || fileLocker.Dir != dir {
+		t.Errorf("Unexpected locker %#v", locker)
+	}
+
+	locker, err = Open("redis://" + server.Addr() + "/0?prefix=app:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if redisLocker, ok := locker.(*RedisLocker); !ok || redisLocker.Prefix != "app:" {
+		t.Errorf("Unexpected locker %#v", locker)
+	}
+	lock := NewLock("opened", locker).WithDuration(time.Minute)
+	if err := lock.Acquire(); err != nil {
+		t.Error(err)
+	}
+
+	locker, err = Open("sqlite://" + filepath.Join(dir, "locks.db") + "?prefix=app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sqlLocker, ok := locker.(*SQLLocker); !ok || sqlLocker.Dialect != SQLDialectSQLite || sqlLocker.TablePrefix != "app" {
+		t.Errorf("Unexpected locker %#v", locker)
+	}
+	if err := NewLock("opened", locker).WithDuration(time.Minute).Acquire(); err != nil {
+		t.Error(err)
+	}
+
+	kubeconfig := filepath.Join(dir, "kubeconfig")
+	config := "apiVersion: v1\nkind: Config\nclusters:\n- name: test\n  cluster:\n    server: https://127.0.0.1:6443\n" +
+		"contexts:\n- name: test\n  context:\n    cluster: test\ncurrent-context: test\n"
+	if err := ioutil.WriteFile(kubeconfig, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	locker, err = Open("kube://my-namespace?prefix=app&kubeconfig=" + kubeconfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kubeLocker, ok := locker.(*KubeLocker); !ok || kubeLocker.Namespace != "my-namespace" || kubeLocker.Prefix != "app" {
+		t.Errorf("Unexpected locker %#v", locker)
+	}
+
+	if _, err := Open("unknown://somewhere"); err == nil {
+		t.Error("Expected unknown scheme to fail")
+	}
+}
+
+func TestOpenEtcdTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lockheed-registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	locker, err := Open("etcds://127.0.0.1:2379,127.0.0.2:2379/app/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	etcdLocker, ok := locker.(*EtcdLocker)
+	if !ok || etcdLocker.Prefix != "/app/" {
+		t.Fatalf("Unexpected locker %#v", locker)
+	}
+	defer etcdLocker.Client.Close()
+	endpoints := etcdLocker.Client.Endpoints()
+	if len(endpoints) != 2 || endpoints[0] != "https://127.0.0.1:2379" || endpoints[1] != "https://127.0.0.2:2379" {
+		t.Errorf("Expected TLS endpoints, got %v", endpoints)
+	}
+
+	cacert := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(cacert, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open("etcds://127.0.0.1:2379/?cacert=" + cacert); err == nil {
+		t.Error("Expected a CA file without certificates to fail")
+	}
+	if _, err := Open("etcds://127.0.0.1:2379/?cert=" + filepath.Join(dir, "missing.pem")); err == nil {
+		t.Error("Expected a missing client certificate to fail")
+	}
+}
+
+func TestRegister(t *testing.T) {
+	var opened *url.URL
+	Register("test", func(u *url.URL) (LockerInterface, error) {
+		opened = u
+		return NewMemoryLocker(), nil
+	})
+	if _, err := Open("test://host/path?option=value"); err != nil {
+		t.Error(err)
+	}
+	if opened == nil || opened.Host != "host" || opened.Query().Get("option") != "value" {
+		t.Error("Expected registered opener to receive the parsed connection string")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected duplicate registration to panic")
+		}
+	}()
+	Register("memory", openMemoryLocker)
+}
@@ -0,0 +1,411 @@
+package lockheed
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// sqlMaxAttempts bounds the number of conditional update attempts of a single operation
+	sqlMaxAttempts = 10
+	// sqlBackoff is the step by which the random delay between attempts grows
+	sqlBackoff = 5 * time.Millisecond
+)
+
+type SQLDialect string
+
+const (
+	SQLDialectSQLite   SQLDialect = "sqlite"
+	SQLDialectPostgres SQLDialect = "postgres"
+)
+
+// SQLLocker keeps lock state in relational tables, created automatically on first use.
+// The authoritative JSON state of a lock is stored along with a version and updated
+// conditionally on it, active leases and tags are kept in their own tables within the
+// same transaction so that listing can filter on them in SQL.
+type SQLLocker struct {
+	DB          *sql.DB
+	Dialect     SQLDialect
+	TablePrefix string
+	// Clock is also used for filtering on expiry in SQL
+	Clock      Clock
+	schemaOnce sync.Once
+	schemaErr  error
+}
+
+func NewSQLLocker(db *sql.DB, dialect SQLDialect) *SQLLocker {
+	return &SQLLocker{
+		DB:          db,
+		Dialect:     dialect,
+		TablePrefix: "lockheed",
+	}
+}
+
+func (locker *SQLLocker) locksTable() string {
+	return locker.TablePrefix + "_locks"
+}
+
+func (locker *SQLLocker) leasesTable() string {
+	return locker.TablePrefix + "_leases"
+}
+
+func (locker *SQLLocker) tagsTable() string {
+	return locker.TablePrefix + "_tags"
+}
+
+// rebind rewrites ? placeholders to the style of the dialect
+func (locker *SQLLocker) rebind(query string) string {
+	if locker.Dialect != SQLDialectPostgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// CreateSchema creates the tables used by the locker unless they already exist
+func (locker *SQLLocker) CreateSchema() error {
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS ` + locker.locksTable() + ` (
+			name VARCHAR(255) PRIMARY KEY,
+			lock_type VARCHAR(32) NOT NULL,
+			state TEXT NOT NULL,
+			version BIGINT NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS ` + locker.leasesTable() + ` (
+			lock_name VARCHAR(255) NOT NULL,
+			holder VARCHAR(255) NOT NULL,
+			mode VARCHAR(32) NOT NULL,
+			expires_at BIGINT NOT NULL,
+			PRIMARY KEY (lock_name, holder)
+		)`,
+		`CREATE TABLE IF NOT EXISTS ` + locker.tagsTable() + ` (
+			lock_name VARCHAR(255) NOT NULL,
+			tag VARCHAR(255) NOT NULL,
+			PRIMARY KEY (lock_name, tag)
+		)`,
+	}
+	for _, statement := range statements {
+		if _, err := locker.DB.Exec(statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (locker *SQLLocker) ensureSchema() error {
+	locker.schemaOnce.Do(func() {
+		locker.schemaErr = locker.CreateSchema()
+	})
+	return locker.schemaErr
+}
+
+// toMillis converts t to milliseconds since the epoch, without going through UnixNano
+// which overflows for the year 9999 expiry of leases with no duration
+func toMillis(t time.Time) int64 {
+	return t.Unix()*1000 + int64(t.Nanosecond())/int64(time.Millisecond)
+}
+
+// modify runs fn on the state of the lock within a transaction and stores it conditionally
+// on the version it was read at, retrying after a growing random delay when it changed in
+// the meantime or SQLite refused the transaction as the database was locked. A missing
+// lock is created only if create is set.
+func (locker *SQLLocker) modify(l *Lock, create bool, fn func(lockState *Lock) error) error {
+	if err := locker.ensureSchema(); err != nil {
+		return err
+	}
+	for attempt := 1; ; attempt++ {
+		done, fnErr, err := locker.modifyAttempt(l, create, fn)
+		if err != nil && !locker.isBusy(err) {
+			return err
+		}
+		if done {
+			return fnErr
+		}
+		if attempt >= sqlMaxAttempts {
+			if err != nil {
+				return err
+			}
+			return fmt.Errorf("Lock %s changed during %d attempts: %w", l.Name, attempt, ErrConflict)
+		}
+		if err := backoffWait(l.OperationContext(), attempt, sqlBackoff); err != nil {
+			return err
+		}
+	}
+}
+
+// isBusy reports whether err is SQLite refusing a transaction because another one kept the
+// database locked for longer than the busy timeout of the connection. Drivers report the
+// error as a message only, so it is recognized by its text.
+func (locker *SQLLocker) isBusy(err error) bool {
+	if locker.Dialect != SQLDialectSQLite {
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "database is locked") || strings.Contains(msg, "SQLITE_BUSY")
+}
+
+func (locker *SQLLocker) modifyAttempt(l *Lock, create bool, fn func(lockState *Lock) error) (bool, error, error) {
+	ctx := l.OperationContext()
+	tx, err := locker.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, nil, err
+	}
+	defer tx.Rollback()
+	if locker.Dialect == SQLDialectSQLite {
+		// write first so that the transaction takes the write lock right away, waiting for
+		// other writers, rather than failing to upgrade its read lock once it read the state
+		_, err := tx.ExecContext(ctx, locker.rebind(`UPDATE `+locker.locksTable()+` SET version = version WHERE name = ?`), l.Name)
+		if err != nil {
+			return false, nil, err
+		}
+	}
+
+	query := `SELECT state, version FROM ` + locker.locksTable() + ` WHERE name = ?`
+	if locker.Dialect == SQLDialectPostgres {
+		query += ` FOR UPDATE`
+	}
+	var data string
+	var version int64
+	err = tx.QueryRowContext(ctx, locker.rebind(query), l.Name).Scan(&data, &version)
+	exists := err == nil
+	if err != nil && err != sql.ErrNoRows {
+		return false, nil, err
+	}
+	if !exists && !create {
+		return false, nil, fmt.Errorf("Lock %s does not exist: %w", l.Name, ErrLockNotFound)
+	}
+
+	lockState := &Lock{Name: l.Name}
+	if exists {
+		if err := decodeLockState([]byte(data), lockState); err != nil {
+			return false, nil, err
+		}
+	}
+	updated, changed, fnErr := applyChange(lockState, fn)
+	if updated == nil || (exists && !changed) {
+		return true, fnErr, nil
+	}
+
+	if exists {
+		result, err := tx.ExecContext(ctx, locker.rebind(`UPDATE `+locker.locksTable()+
+			` SET state = ?, lock_type = ?, version = version + 1 WHERE name = ? AND version = ?`),
+			string(updated), string(lockState.LockType), l.Name, version)
+		if err != nil {
+			return false, nil, err
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return false, nil, err
+		}
+		if affected == 0 {
+			return false, nil, nil
+		}
+	} else {
+		_, err := tx.ExecContext(ctx, locker.rebind(`INSERT INTO `+locker.locksTable()+
+			` (name, lock_type, state, version) VALUES (?, ?, ?, 1)`),
+			l.Name, string(lockState.LockType), string(updated))
+		if err != nil {
+			// somebody else might have created the lock in the meantime
+			tx.Rollback()
+			if found, checkErr := locker.lockExists(l); checkErr == nil && found {
+				return false, nil, nil
+			}
+			return false, nil, err
+		}
+	}
+
+	if err := locker.storeIndexes(tx, lockState); err != nil {
+		return false, nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, nil, err
+	}
+	return true, fnErr, nil
+}
+
+func (locker *SQLLocker) lockExists(l *Lock) (bool, error) {
+	var count int
+	err := locker.DB.QueryRowContext(l.OperationContext(), locker.rebind(`SELECT COUNT(*) FROM `+locker.locksTable()+` WHERE name = ?`), l.Name).Scan(&count)
+	return count > 0, err
+}
+
+// storeIndexes replaces the rows of active leases and tags of the lock
+func (locker *SQLLocker) storeIndexes(tx *sql.Tx, lockState *Lock) error {
+	if _, err := tx.Exec(locker.rebind(`DELETE FROM `+locker.leasesTable()+` WHERE lock_name = ?`), lockState.Name); err != nil {
+		return err
+	}
+	for key, lease := range lockState.Leases {
+		if lease.Pending {
+			continue
+		}
+		_, err := tx.Exec(locker.rebind(`INSERT INTO `+locker.leasesTable()+` (lock_name, holder, mode, expires_at) VALUES (?, ?, ?, ?)`),
+			lockState.Name, key, string(lease.Mode), toMillis(lease.Expires))
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(locker.rebind(`DELETE FROM `+locker.tagsTable()+` WHERE lock_name = ?`), lockState.Name); err != nil {
+		return err
+	}
+	for _, tag := range uniqueTags(lockState.Tags) {
+		_, err := tx.Exec(locker.rebind(`INSERT INTO `+locker.tagsTable()+` (lock_name, tag) VALUES (?, ?)`), lockState.Name, tag)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func uniqueTags(tags []string) []string {
+	var result []string
+	for _, tag := range tags {
+		if !stringInSlice(result, tag) {
+			result = append(result, tag)
+		}
+	}
+	return result
+}
+
+// conditionSQL translates the parts of the condition which can be evaluated in SQL into
+// a WHERE clause on the locks table. Parts which can not be translated are left out, so the
+// clause matches a superset of the locks and the condition still needs to be evaluated.
+func (locker *SQLLocker) conditionSQL(c *Condition) (string, []interface{}, bool) {
+	if c.Conditions != nil {
+		var clauses []string
+		var args []interface{}
+		for i := range *c.Conditions {
+			clause, clauseArgs, ok := locker.conditionSQL(&(*c.Conditions)[i])
+			if !ok {
+				if c.Operation == OperationOr {
+					return "", nil, false
+				}
+				continue
+			}
+			clauses = append(clauses, clause)
+			args = append(args, clauseArgs...)
+		}
+		switch c.Operation {
+		case OperationAnd:
+			if len(clauses) == 0 {
+				return "", nil, false
+			}
+			return "(" + strings.Join(clauses, " AND ") + ")", args, true
+		case OperationOr:
+			if len(clauses) == 0 {
+				return "", nil, false
+			}
+			return "(" + strings.Join(clauses, " OR ") + ")", args, true
+		}
+		return "", nil, false
+	}
+	switch {
+	case c.Field == FieldTags && c.Operation == OperationContains:
+		tag, ok := c.Value.(string)
+		if !ok {
+			return "", nil, false
+		}
+		return `name IN (SELECT lock_name FROM ` + locker.tagsTable() + ` WHERE tag = ?)`, []interface{}{tag}, true
+	case c.Field == FieldAcquired && c.Operation == OperationEquals:
+		acquired, ok := c.Value.(bool)
+		if !ok {
+			return "", nil, false
+		}
+		clause := `name IN (SELECT lock_name FROM ` + locker.leasesTable() + ` WHERE expires_at > ?)`
+		if !acquired {
+			clause = "NOT " + clause
+		}
+		return clause, []interface{}{toMillis(locker.clock().Now())}, true
+	}
+	return "", nil, false
+}
+
+// GetMatchingLocks returns the locks matching the condition as far as it could be evaluated
+// in SQL, the result might contain locks not matching the condition
+func (locker *SQLLocker) GetMatchingLocks(c *Condition) ([]*Lock, error) {
+	var result []*Lock
+	if err := locker.ensureSchema(); err != nil {
+		return result, err
+	}
+	query := `SELECT state FROM ` + locker.locksTable()
+	var args []interface{}
+	if c != nil {
+		if clause, clauseArgs, ok := locker.conditionSQL(c); ok {
+			query += ` WHERE ` + clause
+			args = clauseArgs
+		}
+	}
+	query += ` ORDER BY name`
+	rows, err := locker.DB.Query(locker.rebind(query), args...)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return result, err
+		}
+		lockState := &Lock{}
+		if err := decodeLockState([]byte(data), lockState); err != nil {
+			return result, err
+		}
+		result = append(result, lockState)
+	}
+	return result, rows.Err()
+}
+
+func (locker *SQLLocker) GetAllLocks() ([]*Lock, error) {
+	return locker.GetMatchingLocks(nil)
+}
+
+func (locker *SQLLocker) GetLock(name string) (*Lock, error) {
+	var data string
+	err := locker.DB.QueryRow(locker.rebind(`SELECT state FROM `+locker.locksTable()+` WHERE name = ?`), name).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("Lock %s does not exist: %w", name, ErrLockNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	lockState := &Lock{}
+	if err := decodeLockState([]byte(data), lockState); err != nil {
+		return nil, err
+	}
+	return lockState, nil
+}
+
+func (locker *SQLLocker) Acquire(l *Lock) error {
+	return locker.modify(l, true, func(lockState *Lock) error {
+		return lockState.grant(l)
+	})
+}
+
+func (locker *SQLLocker) Renew(l *Lock) error {
+	return locker.modify(l, false, func(lockState *Lock) error {
+		return lockState.renew(l)
+	})
+}
+
+func (locker *SQLLocker) Release(l *Lock) error {
+	return locker.modify(l, false, func(lockState *Lock) error {
+		lockState.release(l)
+		return nil
+	})
+}
+
+func (locker *SQLLocker) clock() Clock {
+	return clockOrReal(locker.Clock)
+}
@@ -0,0 +1,182 @@
+package lockheed
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func GetTestSQLLocker(t *testing.T) (*SQLLocker, func()) {
+	dir, err := ioutil.TempDir("", "lockheed-sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened, err := Open("sqlite://" + filepath.Join(dir, "locks.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	locker := opened.(*SQLLocker)
+	return locker, func() {
+		locker.DB.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSQLLocker(t *testing.T) {
+	locker, cleanup := GetTestSQLLocker(t)
+	defer cleanup()
+
+	lockA := NewLock("testlock", locker).WithDuration(10 * time.Second).WithTags([]string{"testtag"})
+	if err := lockA.Acquire(); err != nil {
+		t.Error(err)
+	}
+	lockB := NewLock("testlock", locker).WithDuration(10 * time.Second)
+	if err := lockB.Acquire(); err == nil {
+		t.Error("Expected to fail")
+	}
+	if err := lockA.Renew(); err != nil {
+		t.Error(err)
+	}
+	lockC := NewLock("testlock2", locker).WithDuration(10 * time.Second).WithTags([]string{"testtag", "other"})
+	if err := lockC.Acquire(); err != nil {
+		t.Error(err)
+	}
+	if err := lockC.Release(); err != nil {
+		t.Error(err)
+	}
+	lockD := NewLock("testlock3", locker).WithDuration(10 * time.Second).WithTags([]string{"other"})
+	if err := lockD.Acquire(); err != nil {
+		t.Error(err)
+	}
+
+	cond := &Condition{
+		Operation: OperationAnd,
+		Conditions: &[]Condition{
+			Condition{Operation: OperationEquals, Field: FieldAcquired, Value: true},
+			Condition{Operation: OperationContains, Field: FieldTags, Value: "testtag"},
+		},
+	}
+	locks, err := GetLocks(locker, cond)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(locks) != 1 || locks[0].Name != "testlock" {
+		t.Error("Lock not listed as expected")
+	}
+	matching, err := locker.GetMatchingLocks(cond)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(matching) != 1 {
+		t.Errorf("Expected condition to be evaluated in SQL, got %d locks", len(matching))
+	}
+	all, err := locker.GetAllLocks()
+	if err != nil {
+		t.Error(err)
+	}
+	if len(all) != 3 {
+		t.Errorf("Expected 3 locks, got %d", len(all))
+	}
+
+	if err := lockA.Release(); err != nil {
+		t.Error(err)
+	}
+	if err := lockB.Acquire(); err != nil {
+		t.Error(err)
+	}
+	if err := NewLock("missing", locker).Release(); err == nil {
+		t.Error("Expected release of missing lock to fail")
+	}
+}
+
+func TestSQLLockerConcurrency(t *testing.T) {
+	opened, cleanup := GetTestSQLLocker(t)
+	defer cleanup()
+	// a database opened without immediate transactions relies on retries of busy ones
+	dir, err := ioutil.TempDir("", "lockheed-sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "locks.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, locker := range []*SQLLocker{opened, NewSQLLocker(db, SQLDialectSQLite)} {
+		var wg sync.WaitGroup
+		failures := make(chan error, 100)
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 10; j++ {
+					lock := NewLock("shared", locker).WithDuration(time.Minute).WithLockType(LockTypeSemaphore).WithMaxLeases(100)
+					if err := lock.Acquire(); err != nil {
+						failures <- err
+						continue
+					}
+					if err := lock.Release(); err != nil {
+						failures <- err
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		close(failures)
+		for err := range failures {
+			t.Error(err)
+		}
+	}
+}
+
+func TestSQLLockerNoDuration(t *testing.T) {
+	locker, cleanup := GetTestSQLLocker(t)
+	defer cleanup()
+
+	if err := NewLock("forever", locker).Acquire(); err != nil {
+		t.Fatal(err)
+	}
+	cond := &Condition{Operation: OperationEquals, Field: FieldAcquired, Value: true}
+	locks, err := locker.GetMatchingLocks(cond)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(locks) != 1 || locks[0].Name != "forever" {
+		t.Error("Expected lock held with no duration to be listed as acquired")
+	}
+}
+
+func TestSQLLockerConditionPushdown(t *testing.T) {
+	locker := NewSQLLocker(nil, SQLDialectPostgres)
+	cond := &Condition{
+		Operation: OperationOr,
+		Conditions: &[]Condition{
+			Condition{Operation: OperationContains, Field: FieldTags, Value: "a"},
+			Condition{Operation: OperationContains, Field: FieldTags, Value: "b"},
+		},
+	}
+	clause, args, ok := locker.conditionSQL(cond)
+	if !ok || len(args) != 2 {
+		t.Error("Expected condition to be translated")
+	}
+	if query := locker.rebind(clause); query != "(name IN (SELECT lock_name FROM lockheed_tags WHERE tag = $1) OR name IN (SELECT lock_name FROM lockheed_tags WHERE tag = $2))" {
+		t.Errorf("Unexpected query %s", query)
+	}
+
+	(*cond.Conditions)[1] = Condition{Operation: OperationEquals, Field: FieldTags, Value: "b"}
+	if _, _, ok := locker.conditionSQL(cond); ok {
+		t.Error("Expected or with an untranslatable branch not to be pushed down")
+	}
+	cond.Operation = OperationAnd
+	if clause, _, ok := locker.conditionSQL(cond); !ok || clause != "(name IN (SELECT lock_name FROM lockheed_tags WHERE tag = ?))" {
+		t.Error("Expected translatable part of and to be pushed down")
+	}
+}
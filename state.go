@@ -0,0 +1,78 @@
+package lockheed
+
+import "fmt"
+
+// LockState is the stage of its lifecycle a lock instance is in, see Lock.State
+type LockState string
+
+const (
+	// LockStateIdle is the state of a lock that was not acquired yet or failed to be acquired
+	LockStateIdle LockState = "idle"
+	// LockStateAcquiring is the state of a lock while an acquire is in progress
+	LockStateAcquiring LockState = "acquiring"
+	// LockStateHeld is the state of a lock while this instance holds its lease
+	LockStateHeld LockState = "held"
+	// LockStateRenewing is the state of a held lock while its lease is being renewed
+	LockStateRenewing LockState = "renewing"
+	// LockStateLost is the state of a lock after its lease was lost while held
+	LockStateLost LockState = "lost"
+	// LockStateReleased is the state of a lock after it was released
+	LockStateReleased LockState = "released"
+)
+
+// lockStateTransitions lists the states every state can change to
+var lockStateTransitions = map[LockState][]LockState{
+	LockStateIdle:      {LockStateAcquiring, LockStateReleased},
+	LockStateAcquiring: {LockStateHeld, LockStateIdle},
+	LockStateHeld:      {LockStateAcquiring, LockStateRenewing, LockStateLost, LockStateReleased},
+	LockStateRenewing:  {LockStateHeld, LockStateLost},
+	LockStateLost:      {LockStateAcquiring, LockStateReleased},
+	LockStateReleased:  {LockStateAcquiring},
+}
+
+// State returns the current lifecycle state of the lock
+func (l *Lock) State() LockState {
+	l.holdMutex.Lock()
+	defer l.holdMutex.Unlock()
+	return l.lifecycle
+}
+
+// setState moves the lock to state to, failing if that is not allowed from the current state
+func (l *Lock) setState(to LockState) error {
+	l.holdMutex.Lock()
+	from := l.lifecycle
+	err := l.setStateLocked(to)
+	l.holdMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	l.EmitStateChanged(from, to)
+	return nil
+}
+
+// setStateIf moves the lock from state from to state to, unless it already left state from
+func (l *Lock) setStateIf(from LockState, to LockState) {
+	l.holdMutex.Lock()
+	if l.lifecycle != from {
+		l.holdMutex.Unlock()
+		return
+	}
+	err := l.setStateLocked(to)
+	l.holdMutex.Unlock()
+	if err == nil {
+		l.EmitStateChanged(from, to)
+	}
+}
+
+func (l *Lock) setStateLocked(to LockState) error {
+	if l.lifecycle == "" {
+		return ErrNotInitialized
+	}
+	for _, allowed := range lockStateTransitions[l.lifecycle] {
+		if allowed == to {
+			l.lifecycle = to
+			return nil
+		}
+	}
+	return fmt.Errorf("Lock %s(%s) can not change from %s to %s: %w", l.Name, l.InstanceID, l.lifecycle, to, ErrInvalidTransition)
+}
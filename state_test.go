@@ -0,0 +1,98 @@
+package lockheed
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestLockStateTransitions(t *testing.T) {
+	locker := &stubLocker{}
+	lock := NewLock("stateful", locker).WithDuration(time.Hour).WithEventHandler(nil)
+	sub, err := lock.Subscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	if lock.State() != LockStateIdle {
+		t.Errorf("Expected idle lock, got %s", lock.State())
+	}
+	if err := lock.Renew(); !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("Expected renewal of idle lock to be refused, got %v", err)
+	}
+
+	if err := lock.Acquire(); err != nil {
+		t.Error(err)
+	}
+	if err := lock.Renew(); err != nil {
+		t.Error(err)
+	}
+	if lock.State() != LockStateHeld {
+		t.Errorf("Expected held lock, got %s", lock.State())
+	}
+	locker.renewErr = fmt.Errorf("No lease to renew: %w", ErrNotHolder)
+	if err := lock.Renew(); err == nil {
+		t.Error("Expected renewal to fail")
+	}
+	if lock.State() != LockStateLost {
+		t.Errorf("Expected lost lock, got %s", lock.State())
+	}
+	if err := lock.Release(); err != nil {
+		t.Error(err)
+	}
+
+	var states []LockState
+	for len(sub.C) > 0 {
+		if event := <-sub.C; event.Code == EventStateChanged {
+			states = append(states, event.State)
+		}
+	}
+	expected := []LockState{LockStateAcquiring, LockStateHeld, LockStateRenewing, LockStateHeld, LockStateRenewing, LockStateLost, LockStateReleased}
+	if fmt.Sprint(states) != fmt.Sprint(expected) {
+		t.Errorf("Expected states %v, got %v", expected, states)
+	}
+}
+
+func TestLockStateAcquireFailed(t *testing.T) {
+	locker := &stubLocker{acquireErr: errors.New("unavailable")}
+	lock := NewLock("failing", locker)
+	if err := lock.Acquire(); err == nil {
+		t.Error("Failure expected")
+	}
+	if lock.State() != LockStateIdle {
+		t.Errorf("Expected idle lock, got %s", lock.State())
+	}
+}
+
+func TestMaintainOncePerHold(t *testing.T) {
+	lock := NewLock("maintained", &stubLocker{}).WithDuration(time.Hour).WithRenewInterval(time.Hour).WithEventHandler(nil)
+	sub, err := lock.Subscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	for i := 0; i < 3; i++ {
+		if err := lock.Acquire(); err != nil {
+			t.Error(err)
+		}
+	}
+	go lock.Maintain()
+
+	started := 0
+	timeout := time.After(100 * time.Millisecond)
+	for done := false; !done; {
+		select {
+		case event := <-sub.C:
+			if event.Code == EventMaintainStarted {
+				started++
+			}
+		case <-timeout:
+			done = true
+		}
+	}
+	if started != 1 {
+		t.Errorf("Expected a single maintain loop, got %d", started)
+	}
+	lock.Release()
+}
@@ -0,0 +1,125 @@
+package lockheed
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// LockStatus describes the state of a lock at the time it was read
+type LockStatus struct {
+	Name     string
+	LockType LockType
+	Tags     []string
+	// Holders lists the active leases on the lock, ordered by expiry
+	Holders []HolderStatus
+	// Waiters lists the tickets of the waiter queue in order of arrival
+	Waiters []QueueTicket
+	// Transitioned is the last time a lease was granted or dropped, zero if unknown
+	Transitioned time.Time
+	// Held reports whether the lock instance the status was requested by holds the lock
+	Held bool
+}
+
+// HolderStatus describes a single lease on a lock
+type HolderStatus struct {
+	InstanceID string
+	Mode       LeaseMode
+	Weight     int
+	Token      uint64
+	Expires    time.Time
+	// TTL is the time remaining until the lease expires
+	TTL time.Duration
+	// Pending marks an exclusive request waiting for shared leases to go away
+	Pending bool
+}
+
+// GetterInterface is implemented by lockers able to read the state of a single lock
+// without listing all of them
+type GetterInterface interface {
+	// GetLock returns the state of the named lock, or an error matching ErrLockNotFound
+	GetLock(name string) (*Lock, error)
+}
+
+// GetLock returns the state of the named lock, listing all locks of the locker
+// unless it implements GetterInterface
+func GetLock(locker LockerInterface, name string) (*Lock, error) {
+	if getter, ok := locker.(GetterInterface); ok {
+		return getter.GetLock(name)
+	}
+	locks, err := locker.GetAllLocks()
+	if err != nil {
+		return nil, err
+	}
+	for _, lock := range locks {
+		if lock.Name == name {
+			return lock, nil
+		}
+	}
+	return nil, fmt.Errorf("Lock %s does not exist: %w", name, ErrLockNotFound)
+}
+
+// Describe reads the state of the named lock without acquiring it, as of the time of
+// the clock of the locker
+func Describe(locker LockerInterface, name string) (*LockStatus, error) {
+	lockState, err := GetLock(locker, name)
+	if err != nil {
+		return nil, err
+	}
+	return lockState.status("", lockerClock(locker).Now()), nil
+}
+
+// Describe reads the state of the lock without acquiring it, reporting whether
+// the lease of this lock instance is among the holders
+func (l *Lock) Describe() (*LockStatus, error) {
+	lockState, err := GetLock(l.Locker, l.Name)
+	if err != nil {
+		return nil, err
+	}
+	return lockState.status(l.holderID(), l.clock().Now()), nil
+}
+
+// status builds the status of the stored lock state as seen by holder at given time
+func (state *Lock) status(holder string, now time.Time) *LockStatus {
+	status := &LockStatus{
+		Name:     state.Name,
+		LockType: state.LockType,
+		Tags:     append([]string(nil), state.Tags...),
+	}
+	if status.LockType == "" {
+		status.LockType = LockTypeMutex
+	}
+	if state.Transitioned != nil {
+		status.Transitioned = *state.Transitioned
+	}
+	for key, lease := range state.Leases {
+		if lease.ExpiredAt(now) {
+			continue
+		}
+		status.Holders = append(status.Holders, HolderStatus{
+			InstanceID: lease.InstanceID,
+			Mode:       lease.Mode,
+			Weight:     lease.weight(),
+			Token:      lease.Token,
+			Expires:    lease.Expires,
+			TTL:        lease.Expires.Sub(now),
+			Pending:    lease.Pending,
+		})
+		if holder != "" && key == holder && !lease.Pending {
+			status.Held = true
+		}
+	}
+	sort.Slice(status.Holders, func(i, j int) bool {
+		a, b := status.Holders[i], status.Holders[j]
+		if a.Expires.Equal(b.Expires) {
+			return a.InstanceID < b.InstanceID
+		}
+		return a.Expires.Before(b.Expires)
+	})
+	for _, ticket := range state.Queue {
+		if now.Before(ticket.Expires) {
+			status.Waiters = append(status.Waiters, ticket)
+		}
+	}
+	return status
+}
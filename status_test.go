@@ -0,0 +1,76 @@
+package lockheed
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDescribe(t *testing.T) {
+	locker := NewMemoryLocker()
+	if _, err := Describe(locker, "deploy"); !errors.Is(err, ErrLockNotFound) {
+		t.Errorf("Expected ErrLockNotFound, got %v", err)
+	}
+
+	holder := NewLock("deploy", locker).WithDuration(time.Minute).WithTags([]string{"prod"})
+	before := time.Now()
+	if err := holder.Acquire(); err != nil {
+		t.Fatal(err)
+	}
+	status, err := holder.Describe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.Held || status.LockType != LockTypeMutex || len(status.Tags) != 1 || status.Tags[0] != "prod" {
+		t.Errorf("Unexpected status %+v", status)
+	}
+	if len(status.Holders) != 1 || status.Holders[0].InstanceID != holder.InstanceID {
+		t.Fatalf("Expected holder %s, got %+v", holder.InstanceID, status.Holders)
+	}
+	if ttl := status.Holders[0].TTL; ttl <= 0 || ttl > time.Minute {
+		t.Errorf("Unexpected TTL %s", ttl)
+	}
+	if status.Transitioned.Before(before) {
+		t.Errorf("Expected transition after %s, got %s", before, status.Transitioned)
+	}
+
+	other := NewLock("deploy", locker)
+	status, err = other.Describe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Held || len(status.Holders) != 1 {
+		t.Errorf("Expected lock held by another instance, got %+v", status)
+	}
+
+	acquired := status.Transitioned
+	if err := holder.Release(); err != nil {
+		t.Error(err)
+	}
+	status, err = Describe(locker, "deploy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Holders) != 0 || status.Transitioned.Before(acquired) {
+		t.Errorf("Expected released lock, got %+v", status)
+	}
+}
+
+func TestDescribeListing(t *testing.T) {
+	// QuorumLocker does not read single locks, so the lock is looked up in the listing
+	locker := NewQuorumLocker(NewMemoryLocker(), NewMemoryLocker(), NewMemoryLocker())
+	holder := NewLock("listed", locker).WithDuration(time.Minute)
+	if err := holder.Acquire(); err != nil {
+		t.Fatal(err)
+	}
+	status, err := holder.Describe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.Held || len(status.Holders) != 1 {
+		t.Errorf("Unexpected status %+v", status)
+	}
+	if _, err := Describe(locker, "missing"); !errors.Is(err, ErrLockNotFound) {
+		t.Errorf("Expected ErrLockNotFound, got %v", err)
+	}
+}